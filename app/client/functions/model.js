@@ -13,9 +13,12 @@ exports.execute = () => {
 
         const transaction = await conn.contract.createTransaction("RunModel");
         transaction.setTransient({"input":inputBuf});
-        const result = await transaction.submit(modelName);
-    
-        console.log(result.toString());
+        const result = JSON.parse((await transaction.submit(modelName)).toString());
+
+        result.outputs.forEach(output => {
+            console.log(`${output.name} (${output.dtype}, shape [${output.shape}]):`);
+            console.log(JSON.stringify(output.values));
+        });
         conn.gateway.disconnect();
     });
 }
@@ -32,7 +35,7 @@ exports.submit = () => {
 
         const conn = await getConnection(user, "org1", modelChaincode);
 
-        await conn.contract.submitTransaction("SaveModel", modelName, hash, ...Object.values(input), ...Object.values(output));
+        await conn.contract.submitTransaction("SaveModel", modelName, hash, JSON.stringify(input), JSON.stringify(output));
 
         conn.gateway.disconnect();
     });
@@ -51,6 +54,84 @@ exports.authorize = () => {
     });
 }
 
+exports.updateMetadata = () => {
+    const usage = "usage: node . updateMetadata 'walletUser' 'modelName' 'metadata.json'";
+    return mainFunction(usage, 3, async (args) => {
+        const user = args[0];
+        const model = args[1];
+        const metadata = fs.readFileSync(args[2]).toString();
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        await conn.contract.submitTransaction('UpdateModelMetadata', model, metadata);
+        console.log(`updated metadata of model ${model}`);
+        conn.gateway.disconnect();
+    });
+}
+
+exports.buyLicense = () => {
+    const usage = "usage: node . buyLicense 'walletUser' 'modelName' 'plan'";
+    return mainFunction(usage, 3, async (args) => {
+        const user = args[0];
+        const model = args[1];
+        const plan = args[2];
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        const result = await conn.contract.submitTransaction('BuyLicense', model, plan);
+        console.log(result.toString());
+        conn.gateway.disconnect();
+    });
+}
+
+exports.getModelStats = () => {
+    const usage = "usage: node . getModelStats 'walletUser' 'modelName' 'from' 'to' (YYYY-MM-DD, '' for no limit)";
+    return mainFunction(usage, 4, async (args) => {
+        const user = args[0];
+        const model = args[1];
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        const result = await conn.contract.evaluateTransaction('GetModelStats', model, args[2], args[3]);
+        console.log(result.toString());
+        conn.gateway.disconnect();
+    });
+}
+
+exports.getEarnings = () => {
+    const usage = "usage: node . getEarnings 'walletUser' 'creator' 'from' 'to' ('' for the wallet user and for no limits)";
+    return mainFunction(usage, 4, async (args) => {
+        const user = args[0];
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        const result = await conn.contract.evaluateTransaction('GetCreatorEarnings', args[1], args[2], args[3]);
+        console.log(result.toString());
+        conn.gateway.disconnect();
+    });
+}
+
+exports.rateModel = () => {
+    const usage = "usage: node . rateModel 'walletUser' 'modelName' 'stars' 'comment'";
+    return mainFunction(usage, 4, async (args) => {
+        const user = args[0];
+        const model = args[1];
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        await conn.contract.submitTransaction('RateModel', model, args[2], args[3]);
+        console.log(`rated model ${model} with ${args[2]} stars`);
+        conn.gateway.disconnect();
+    });
+}
+
+exports.listReviews = () => {
+    const usage = "usage: node . listReviews 'walletUser' 'modelName' 'version' 'bookmark' ('' for all versions and for the first page)";
+    return mainFunction(usage, 4, async (args) => {
+        const user = args[0];
+        const conn = await getConnection(user, "org1", modelChaincode);
+
+        const result = await conn.contract.evaluateTransaction('ListReviews', args[1], args[2], '0', args[3]);
+        console.log(result.toString());
+        conn.gateway.disconnect();
+    });
+}
+
 exports.getModel = () => {
     const usage = "usage: node . getModel 'modelName'";
 
@@ -1,9 +1,15 @@
-const {execute, submit, authorize, getAllModels, getModel, getModelsByUser} = require('./functions/model')
+const {execute, submit, authorize, buyLicense, updateMetadata, getModelStats, getEarnings, rateModel, listReviews, getAllModels, getModel, getModelsByUser} = require('./functions/model')
 const {approve, transferFrom, getAllowance} = require('./functions/allowance');
 const {enroll, buyTokens, getClientID, requestRole, getBalance, getTotalSupply, transfer} = require('./functions/user');
 const functions = {
     submit,
     authorize,
+    buyLicense,
+    updateMetadata,
+    getModelStats,
+    getEarnings,
+    rateModel,
+    listReviews,
     execute,
     approve,
     transferFrom,
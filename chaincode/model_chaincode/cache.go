@@ -0,0 +1,188 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+// modello caricato in memoria. refs conta le esecuzioni in corso, la sessione viene chiusa
+// quando il modello è stato rimosso dalla cache e nessuna esecuzione lo sta usando
+type loadedModel struct {
+	key     string
+	saved   *tf.SavedModel
+	size    int64
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+// cache LRU dei modelli caricati, condivisa da tutte le transazioni, indicizzata per hash del modello.
+// maxBytes limita la somma delle dimensioni su disco dei modelli caricati, 0 = nessun limite
+type modelCache struct {
+	mu         sync.Mutex
+	entries    map[string]*loadedModel
+	lru        *list.List
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+}
+
+var models = newModelCache(envInt("MODEL_CACHE_ENTRIES", 4), int64(envInt("MODEL_CACHE_BYTES", 0)))
+
+func newModelCache(maxEntries int, maxBytes int64) *modelCache {
+	return &modelCache{
+		entries:    make(map[string]*loadedModel),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+func envInt(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// restituisce il modello con hash key, caricandolo da dir se non è in cache.
+// il chiamante deve restituirlo con release
+func (c *modelCache) acquire(key string, dir string) (*loadedModel, error) {
+	c.mu.Lock()
+	if lm, exists := c.entries[key]; exists {
+		lm.refs++
+		c.lru.MoveToFront(lm.elem)
+		c.mu.Unlock()
+		return lm, nil
+	}
+	c.mu.Unlock()
+
+	// il caricamento avviene senza il lock della cache, un'altra transazione potrebbe caricare
+	// lo stesso modello. il lock condiviso sulla directory esclude le installazioni in corso
+	saved, size, err := loadModel(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if lm, exists := c.entries[key]; exists {
+		saved.Session.Close()
+		lm.refs++
+		c.lru.MoveToFront(lm.elem)
+		return lm, nil
+	}
+
+	lm := &loadedModel{key: key, saved: saved, size: size, refs: 1}
+	lm.elem = c.lru.PushFront(lm)
+	c.entries[key] = lm
+	c.bytes += size
+	c.evict()
+
+	log.Printf("loaded model %s, %d models in cache", key, len(c.entries))
+	return lm, nil
+}
+
+func loadModel(dir string) (*tf.SavedModel, int64, error) {
+	lock, err := lockModelDir(dir, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer lock.unlock()
+
+	saved, err := tf.LoadSavedModel(dir, []string{servingTag}, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error loading model: %s", err)
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		saved.Session.Close()
+		return nil, 0, err
+	}
+	return saved, size, nil
+}
+
+func (c *modelCache) release(lm *loadedModel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lm.refs--
+	if lm.evicted && lm.refs == 0 {
+		lm.close()
+	}
+}
+
+// rimuove dalla cache il modello con hash key, ad esempio quando viene ritirato
+func (c *modelCache) invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if lm, exists := c.entries[key]; exists {
+		c.remove(lm)
+	}
+}
+
+// rimuove i modelli usati meno di recente finché non rientra nei limiti.
+// il modello appena caricato resta comunque in cache
+func (c *modelCache) evict() {
+	for c.lru.Len() > 1 && (c.lru.Len() > c.maxEntries || c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back().Value.(*loadedModel))
+	}
+}
+
+func (c *modelCache) remove(lm *loadedModel) {
+	c.lru.Remove(lm.elem)
+	delete(c.entries, lm.key)
+	c.bytes -= lm.size
+	lm.evicted = true
+	if lm.refs == 0 {
+		lm.close()
+	}
+}
+
+func (lm *loadedModel) close() {
+	err := lm.saved.Session.Close()
+	if err != nil {
+		log.Printf("error closing session of model %s: %s", lm.key, err)
+	}
+}
+
+// output idx dell'operazione name del grafo
+func (lm *loadedModel) op(name string, idx int) (tf.Output, error) {
+	op := lm.saved.Graph.Operation(name)
+	if op == nil {
+		return tf.Output{}, fmt.Errorf("op %s not found in model graph", name)
+	}
+	if idx < 0 || idx >= op.NumOutputs() {
+		return tf.Output{}, fmt.Errorf("op %s has %d outputs, requested output %d", name, op.NumOutputs(), idx)
+	}
+	return op.Output(idx), nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// filtro del catalogo, tutti i campi sono opzionali. il prezzo è quello del piano di licenza
+// più economico, 0 per i modelli ad accesso libero. una dimensione -1 in InputShape accetta
+// qualsiasi valore. con Sort "rating" i modelli sono ordinati dalla valutazione media più alta
+type ModelFilter struct {
+	Creator    string   `json:"creator"`
+	Tag        string   `json:"tag"`
+	Task       string   `json:"task"`
+	Status     string   `json:"status"`
+	InputDType string   `json:"input_dtype"`
+	InputShape []int64  `json:"input_shape"`
+	MinPrice   *int     `json:"min_price"`
+	MaxPrice   *int     `json:"max_price"`
+	MinRating  *float64 `json:"min_rating"`
+	Sort       string   `json:"sort"`
+}
+
+const SortRating = "rating"
+
+// pagina del catalogo. Bookmark va passato alla richiesta successiva, è vuoto dopo l'ultima pagina.
+// Fetched è il numero di voci lette per la pagina, Total il numero di modelli che soddisfano il filtro
+type ModelPage struct {
+	Models   []*ModelResult `json:"models"`
+	Bookmark string         `json:"bookmark"`
+	Fetched  int            `json:"fetched"`
+	Total    int            `json:"total"`
+}
+
+func parseModelFilter(filter string) (*ModelFilter, error) {
+	f := new(ModelFilter)
+	if filter == "" {
+		return f, nil
+	}
+	err := json.Unmarshal([]byte(filter), f)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing filter: %s", err)
+	}
+	if f.InputDType != "" {
+		if _, exists := tfTypes[f.InputDType]; !exists {
+			return nil, fmt.Errorf("unknown input dtype %s", f.InputDType)
+		}
+	}
+	if f.Sort != "" && f.Sort != SortRating {
+		return nil, fmt.Errorf("unknown sort %s", f.Sort)
+	}
+	return f, nil
+}
+
+// indice da scorrere per il filtro e attributi della chiave parziale: quello delle valutazioni
+// per l'ordinamento, altrimenti quello dell'autore, del tag o dello stato se indicati,
+// altrimenti le chiavi semplici dei modelli
+func (f *ModelFilter) index() (string, []string) {
+	switch {
+	case f.Sort == SortRating:
+		return ratingIndex, []string{}
+	case f.Creator != "":
+		return devIndex, []string{f.Creator}
+	case f.Tag != "":
+		return tagIndex, []string{f.Tag}
+	case f.Status != "":
+		return statusIndex, []string{f.Status}
+	}
+	return "", nil
+}
+
+// rating serve solo con MinRating e può essere nil negli altri casi
+func (f *ModelFilter) match(m *Model, rating *Rating) bool {
+	if f.Creator != "" && m.Creator != f.Creator {
+		return false
+	}
+	if f.Tag != "" && !containsString(m.Tags, f.Tag) {
+		return false
+	}
+	if f.Status != "" && m.status() != f.Status {
+		return false
+	}
+	if f.Task != "" && (m.Metadata == nil || m.Metadata.Task != f.Task) {
+		return false
+	}
+	if f.InputDType != "" || len(f.InputShape) > 0 {
+		found := false
+		for _, input := range m.Inputs {
+			if f.InputDType != "" && input.DataType != tfTypes[f.InputDType] {
+				continue
+			}
+			if len(f.InputShape) > 0 && !shapeMatches(input.Shape, f.InputShape) {
+				continue
+			}
+			found = true
+			break
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.MinPrice != nil || f.MaxPrice != nil {
+		price, ok := m.minPrice()
+		if !ok {
+			return false
+		}
+		if f.MinPrice != nil && price < *f.MinPrice {
+			return false
+		}
+		if f.MaxPrice != nil && price > *f.MaxPrice {
+			return false
+		}
+	}
+	if f.MinRating != nil && (rating == nil || rating.Count == 0 || rating.Average < *f.MinRating) {
+		return false
+	}
+	return true
+}
+
+// i filtri sui campi dell'indice scelto sono già soddisfatti dalle voci lette
+func (f *ModelFilter) indexOnly() bool {
+	index, _ := f.index()
+	rest := *f
+	switch index {
+	case devIndex:
+		rest.Creator = ""
+	case tagIndex:
+		rest.Tag = ""
+	case statusIndex:
+		rest.Status = ""
+	}
+	return rest.Creator == "" && rest.Tag == "" && rest.Status == "" && rest.Task == "" && rest.InputDType == "" &&
+		len(rest.InputShape) == 0 && rest.MinPrice == nil && rest.MaxPrice == nil && rest.MinRating == nil
+}
+
+func shapeMatches(shape []int64, pattern []int64) bool {
+	if len(shape) != len(pattern) {
+		return false
+	}
+	for i := range shape {
+		if shape[i] != pattern[i] && shape[i] != -1 && pattern[i] != -1 {
+			return false
+		}
+	}
+	return true
+}
+
+// prezzo del piano di licenza più economico. i modelli senza piani hanno prezzo 0 se ad
+// accesso libero e nessun prezzo se richiedono l'approvazione del creatore
+func (m *Model) minPrice() (int, bool) {
+	if len(m.Plans) == 0 {
+		return 0, m.accessPolicy() == AccessOpen
+	}
+	first := true
+	min := 0
+	for _, plan := range m.Plans {
+		if first || plan.Price < min {
+			min = plan.Price
+			first = false
+		}
+	}
+	return min, true
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// iteratore sulle voci dell'indice, o sulle chiavi semplici se index è vuoto.
+// con pageSize 0 restituisce tutte le voci
+func (r *ModelRepository) scan(index string, attrs []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, string, int, error) {
+	if pageSize == 0 {
+		var iterator shim.StateQueryIteratorInterface
+		var err error
+		if index == "" {
+			iterator, err = r.stub.GetStateByRange("", "")
+		} else {
+			iterator, err = r.stub.GetStateByPartialCompositeKey(index, attrs)
+		}
+		return iterator, "", 0, err
+	}
+
+	if index == "" {
+		iterator, metadata, err := r.stub.GetStateByRangeWithPagination("", "", pageSize, bookmark)
+		if err != nil {
+			return nil, "", 0, err
+		}
+		return iterator, metadata.GetBookmark(), int(metadata.GetFetchedRecordsCount()), nil
+	}
+	iterator, metadata, err := r.stub.GetStateByPartialCompositeKeyWithPagination(index, attrs, pageSize, bookmark)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return iterator, metadata.GetBookmark(), int(metadata.GetFetchedRecordsCount()), nil
+}
+
+// modello della voce letta da scan: le chiavi semplici contengono il modello,
+// le voci degli indici il nome nella chiave
+func (r *ModelRepository) entryModel(index string, key string, value []byte) (*Model, error) {
+	if index == "" {
+		// le chiavi composte non sono modelli, Fabric le esclude già dalle query per intervallo
+		if strings.HasPrefix(key, "\x00") {
+			return nil, nil
+		}
+		return modelFromBytes(value)
+	}
+	_, attrs, err := r.stub.SplitCompositeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return r.Get(attrs[len(attrs)-1])
+}
+
+// pagina di modelli che soddisfano il filtro. la paginazione avviene sulle voci dell'indice,
+// quindi una pagina può contenere meno di pageSize modelli se il filtro ne esclude alcuni
+func (r *ModelRepository) List(filter *ModelFilter, pageSize int32, bookmark string) (*ModelPage, error) {
+	index, attrs := filter.index()
+
+	iterator, nextBookmark, fetched, err := r.scan(index, attrs, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	page := ModelPage{Models: []*ModelResult{}, Bookmark: nextBookmark, Fetched: fetched}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+		model, err := r.entryModel(index, entry.Key, entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if model == nil {
+			continue
+		}
+		rating, err := r.Rating(model.Name)
+		if err != nil {
+			return nil, err
+		}
+		if filter.match(model, rating) {
+			result := model.result()
+			result.Rating = rating
+			page.Models = append(page.Models, result)
+		}
+	}
+	if fetched < int(pageSize) {
+		page.Bookmark = ""
+	}
+
+	page.Total, err = r.count(filter)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+// numero di modelli che soddisfano il filtro. se il filtro usa solo il campo dell'indice
+// vengono contate le voci senza leggere i modelli
+func (r *ModelRepository) count(filter *ModelFilter) (int, error) {
+	index, attrs := filter.index()
+
+	iterator, _, _, err := r.scan(index, attrs, 0, "")
+	if err != nil {
+		return 0, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	indexOnly := index != "" && filter.indexOnly()
+	total := 0
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("error reading iterator: %s", err)
+		}
+		if indexOnly {
+			total++
+			continue
+		}
+		model, err := r.entryModel(index, entry.Key, entry.Value)
+		if err != nil {
+			return 0, err
+		}
+		if model == nil {
+			continue
+		}
+		var rating *Rating
+		if filter.MinRating != nil {
+			rating, err = r.Rating(model.Name)
+			if err != nil {
+				return 0, err
+			}
+		}
+		if filter.match(model, rating) {
+			total++
+		}
+	}
+	return total, nil
+}
+
+// catalogo dei modelli con filtro JSON (vedi ModelFilter) e paginazione.
+// va eseguita come query, le query paginate non sono permesse nelle transazioni
+func (sc *SmartContract) ListModels(ctx CustomTransactionContextInterface, filter string, pageSize int, bookmark string) (*ModelPage, error) {
+	f, err := parseModelFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := checkPageSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewModelRepository(ctx).List(f, size, bookmark)
+}
+
+// dimensione della pagina richiesta, quella predefinita se non indicata
+func checkPageSize(pageSize int) (int32, error) {
+	if pageSize <= 0 {
+		return defaultPageSize, nil
+	}
+	if pageSize > maxPageSize {
+		return 0, fmt.Errorf("page size %d exceeds the limit of %d", pageSize, maxPageSize)
+	}
+	return int32(pageSize), nil
+}
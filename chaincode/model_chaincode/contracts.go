@@ -1,18 +1,16 @@
 package main
 
 import (
-	"crypto/sha256"
 	"errors"
 	"log"
+	"strconv"
 
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 
-	tensorflow "github.com/galeone/tensorflow/tensorflow/go"
-	shell "github.com/ipfs/go-ipfs-api"
+	"chaincode/modelhash"
 
-	"github.com/hyperledger/fabric-chaincode-go/shim"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
 )
 
@@ -28,6 +26,19 @@ type UserInfo struct {
 type Prices struct {
 	Upload int `json:"upload"`
 	Use    int `json:"use"`
+	Batch  int `json:"batch"`
+}
+
+// prezzo di un'esecuzione di count elementi: Use per un solo elemento, il prezzo fisso del batch
+// se impostato, altrimenti Use per ogni elemento. deve coincidere con batchPrice del chaincode tokens
+func (p *Prices) batchPrice(count int) int {
+	if count == 1 {
+		return p.Use
+	}
+	if p.Batch > 0 {
+		return p.Batch
+	}
+	return p.Use * count
 }
 
 type ModelUse struct {
@@ -36,12 +47,16 @@ type ModelUse struct {
 	Hash    string `json:"hash"`
 	Price   int    `json:"price"`
 	User    string `json:"user"`
+	Batch   int    `json:"batch"`
 }
 
-// salvataggio sul disco di un modello, inviato come hash di ipfs
-func (sc *SmartContract) SaveModel(ctx CustomTransactionContextInterface, name string, cid string,
-	inputName string, inputDT string, inputShape string, inputIdx int,
-	outputName string, outputDT string, outputShape string, outputIdx int) error {
+const maxBatchSize = 1024
+
+// salvataggio sul disco di un modello. source è la posizione dell'archivio: un CID di ipfs,
+// oppure un URI ipfs://, file://, http(s):// o s3:// con il digest dell'archivio come #sha256=<hex>.
+// la firma viene letta da saved_model.pb, inputs e outputs sono definizioni JSON opzionali
+// (un oggetto o un array) che sostituiscono o completano i tensori letti
+func (sc *SmartContract) SaveModel(ctx CustomTransactionContextInterface, name string, source string, inputs string, outputs string) error {
 
 	userID, err := ctx.GetClientIdentity().GetID()
 	if err != nil {
@@ -74,34 +89,75 @@ func (sc *SmartContract) SaveModel(ctx CustomTransactionContextInterface, name s
 		return fmt.Errorf("insufficient funds. current balance: %d\nneeded: %d", user.Balance, prices.Upload)
 	}
 
-	existing := ctx.GetData()
-
-	if existing != nil {
-		return fmt.Errorf("cannot create world state pair with key %s. Already exists", name)
+	inputDefs, err := parseTensorDefs(inputs)
+	if err != nil {
+		return err
+	}
+	outputDefs, err := parseTensorDefs(outputs)
+	if err != nil {
+		return err
 	}
 
-	sh := shell.NewShell("ipfs_host:5001")
-	file, err := sh.Cat(cid)
+	location, err := parseLocation(source)
 	if err != nil {
 		return err
 	}
+	id := modelDirName(location)
 
-	err = Untar((file), "models/"+cid)
+	file, err := fetchModel(location)
+	if err != nil {
+		return fmt.Errorf("error fetching model %s", err)
+	}
+	defer file.Close()
+
+	err = Untar(file, MODELS_FOLDER+id, defaultExtractPolicy)
 	if err != nil {
 		return fmt.Errorf("error extracting file %s", err)
 	}
 
-	input := Data{
-		Name:     inputName,
-		Shape:    stringToInt(inputShape),
-		DataType: tfTypes[inputDT],
-		Idx:      inputIdx,
+	// gli archivi su ipfs vengono fissati sul nodo, perché non spariscano dopo la registrazione
+	pinned := false
+	if location.Scheme == "ipfs" {
+		c, err := ipfsCID(location)
+		if err != nil {
+			return err
+		}
+		err = ipfsStore.Pin(c)
+		if err != nil {
+			return fmt.Errorf("error pinning %s: %s", c, err)
+		}
+		pinned = true
 	}
-	output := Data{
-		Name:     outputName,
-		DataType: tfTypes[outputDT],
-		Shape:    stringToInt(outputShape),
-		Idx:      outputIdx,
+
+	// i file vengono letti con il lock condiviso, un'altra estrazione dello stesso archivio
+	// può sostituire la directory solo prima o dopo la lettura
+	lock, err := lockModelDir(MODELS_FOLDER+id, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	signature, err := readSignature(MODELS_FOLDER + id)
+	if err != nil {
+		return err
+	}
+	if signature == nil {
+		signature = new(savedSignature)
+	}
+
+	inputData, err := mergeSignature(signature.Inputs, inputDefs, signature.Nodes)
+	if err != nil {
+		return fmt.Errorf("invalid inputs: %s", err)
+	}
+	outputData, err := mergeSignature(signature.Outputs, outputDefs, signature.Nodes)
+	if err != nil {
+		return fmt.Errorf("invalid outputs: %s", err)
+	}
+	for _, input := range inputData {
+		err = validateInputDef(input)
+		if err != nil {
+			return fmt.Errorf("invalid inputs: %s", err)
+		}
 	}
 
 	response = ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("PayUpload")}, ctx.GetStub().GetChannelID())
@@ -110,59 +166,142 @@ func (sc *SmartContract) SaveModel(ctx CustomTransactionContextInterface, name s
 		return fmt.Errorf("error during payment: %s", response.Message)
 	}
 
-	h := sha256.New()
-
-	err = hashDir(MODELS_FOLDER+cid, h)
+	hashString, err := modelhash.HashDir(MODELS_FOLDER + id)
 	if err != nil {
 		return fmt.Errorf("error hashing directory %s", err)
 	}
-	hashString := fmt.Sprintf("%x", h.Sum(nil))
+
+	manifest, modTimes, err := buildManifest(MODELS_FOLDER + id)
+	if err != nil {
+		return fmt.Errorf("error building manifest %s", err)
+	}
+	recordVerification(hashString, modTimes)
 
 	model := Model{
-		Id:           cid,
+		Id:           id,
 		Name:         name,
 		Hash:         hashString,
-		Location:     "models/" + cid,
-		Input:        input,
-		Output:       output,
+		HashScheme:   modelhash.Version,
+		Manifest:     manifest,
+		Location:     "models/" + id,
+		Source:       location.String(),
+		Pinned:       pinned,
+		Inputs:       inputData,
+		Outputs:      outputData,
 		Creator:      userID,
 		AllowedUsers: []string{userID},
+		Status:       StatusActive,
+		AccessPolicy: AccessApproval,
+		Metadata:     &ModelMetadata{Framework: "tensorflow", FrameworkVersion: signature.TFVersion},
 	}
 
-	m, _ := json.Marshal(model)
-
-	devIndexKey, err := ctx.GetStub().CreateCompositeKey("byDev", []string{userID, name})
-	if err != nil {
-		return err
-	}
-	ctx.GetStub().PutState(name, m)
-	ctx.GetStub().PutState(devIndexKey, m)
-
-	return nil
+	return NewModelRepository(ctx).Create(&model)
 
 }
 
 func (sc *SmartContract) GetModel(ctx CustomTransactionContextInterface, name string) (*ModelResult, error) {
-	existing := ctx.GetData()
+	return NewModelRepository(ctx).Result(ctx.Model())
+}
 
-	if existing == nil {
-		return nil, fmt.Errorf("no model with key %s found", name)
+// legge dal transient map gli elementi del batch, un solo elemento se non è un batch, senza decodificarli.
+// gli input con una conversione impostata vengono inviati come immagini o documenti JSON.
+// "inputs" contiene un oggetto JSON chiave -> base64, per i modelli con un solo input
+// è sufficiente "input" con il tensore in base64. "batch" contiene un array JSON di elementi,
+// ognuno nella forma di "inputs" o, con un solo input, una stringa base64
+func readInputs(transientMap map[string][]byte, model *Model) ([]map[string]string, error) {
+	var items []map[string]string
+
+	if batch, exists := transientMap["batch"]; exists {
+		var raw []json.RawMessage
+		err := json.Unmarshal(batch, &raw)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing batch: %s", err)
+		}
+		if len(raw) == 0 {
+			return nil, errors.New("empty batch")
+		}
+		if len(raw) > maxBatchSize {
+			return nil, fmt.Errorf("batch of %d items exceeds the limit of %d", len(raw), maxBatchSize)
+		}
+		for i, r := range raw {
+			item := make(map[string]string)
+			var single string
+			if json.Unmarshal(r, &single) == nil {
+				if len(model.Inputs) != 1 {
+					return nil, fmt.Errorf("model %s has %d inputs, batch item %d must be an object", model.Name, len(model.Inputs), i)
+				}
+				item[model.Inputs[0].Key] = single
+			} else if err := json.Unmarshal(r, &item); err != nil {
+				return nil, fmt.Errorf("error parsing batch item %d: %s", i, err)
+			}
+			items = append(items, item)
+		}
+	} else if inputs, exists := transientMap["inputs"]; exists {
+		item := make(map[string]string)
+		err := json.Unmarshal(inputs, &item)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing inputs: %s", err)
+		}
+		items = append(items, item)
+	} else if input, exists := transientMap["input"]; exists {
+		if len(model.Inputs) != 1 {
+			return nil, fmt.Errorf("model %s has %d inputs, use the inputs key", model.Name, len(model.Inputs))
+		}
+		items = append(items, map[string]string{model.Inputs[0].Key: string(input)})
+	} else {
+		return nil, errors.New("error getting input from transient map")
 	}
 
-	model := new(Model)
-	err := json.Unmarshal(existing, model)
-	if err != nil {
-		return nil, fmt.Errorf("error unmarshaling model %s", err)
+	return items, nil
+}
+
+// decodifica gli elementi e applica le conversioni. gli elementi del batch vengono concatenati
+// lungo la prima dimensione
+func decodeInputs(items []map[string]string, model *Model) (map[string][]byte, error) {
+	decoded := make(map[string][]byte)
+	for i, item := range items {
+		if len(item) != len(model.Inputs) {
+			return nil, fmt.Errorf("model %s expects %d inputs, item %d has %d", model.Name, len(model.Inputs), i, len(item))
+		}
+		for key, value := range item {
+			d, err := base64.StdEncoding.DecodeString(value)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding input %s of item %d", key, i)
+			}
+			if preprocess, exists := model.Preprocess[key]; exists {
+				input, err := model.input(key)
+				if err != nil {
+					return nil, err
+				}
+				d, err = preprocess.tensorBytes(d, *input)
+				if err != nil {
+					return nil, fmt.Errorf("error preprocessing input %s of item %d: %s", key, i, err)
+				}
+			}
+			decoded[key] = append(decoded[key], d...)
+		}
 	}
+	return decoded, nil
+}
 
-	result := ModelResult{
-		Name:   model.Name,
-		Input:  model.Input,
-		Output: model.Output,
+// output richiesti nel transient map con la chiave "outputs", tutti se assente
+func readOutputs(transientMap map[string][]byte, model *Model) ([]Data, error) {
+	requested, exists := transientMap["outputs"]
+	if !exists {
+		return model.Outputs, nil
 	}
-	return &result, nil
+
+	var keys []string
+	err := json.Unmarshal(requested, &keys)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing requested outputs: %s", err)
+	}
+	return model.selectOutputs(keys)
 }
 
+// esegue il modello e restituisce un RunResult in JSON. gli output richiesti possono essere
+// indicati nel transient map con la chiave "outputs" come array JSON, altrimenti vengono
+// restituiti tutti; "format" sceglie tra valori annidati o piatti e byte in base64
 func (sc *SmartContract) RunModel(ctx CustomTransactionContextInterface, name string) (string, error) {
 
 	userID, err := ctx.GetClientIdentity().GetID()
@@ -170,47 +309,43 @@ func (sc *SmartContract) RunModel(ctx CustomTransactionContextInterface, name st
 		return "", err
 	}
 
-	existing := ctx.GetData()
-
-	if existing == nil {
-		return "", fmt.Errorf("no model with key %s found", name)
-	}
+	model := ctx.Model()
 
 	transientMap, err := ctx.GetStub().GetTransient()
 	if err != nil {
 		return "", err
 	}
-	input, exists := transientMap["input"]
-	if !exists {
-		return "", errors.New("error getting input from transient map")
-	}
-
-	decodedInput, err := base64.StdEncoding.DecodeString(string(input))
 
+	items, err := readInputs(transientMap, model)
 	if err != nil {
-		return "", fmt.Errorf("error decoding input")
+		return "", err
 	}
+	count := len(items)
 
-	model := new(Model)
-	err = json.Unmarshal(existing, model)
-
+	outputs, err := readOutputs(transientMap, model)
 	if err != nil {
-		return "", fmt.Errorf("error unmarshaling %s", err)
+		return "", err
 	}
 
-	h := sha256.New()
-	err = hashDir(model.Location, h)
+	format, err := readOutputFormat(transientMap)
 	if err != nil {
 		return "", err
 	}
-	hashString := fmt.Sprintf("%x", h.Sum(nil))
-	if hashString != model.Hash {
-		return "", fmt.Errorf("hash doesn't match")
+	if format.Labels {
+		if model.PostProcess == nil {
+			return "", fmt.Errorf("model %s has no post-processing", name)
+		}
+		err = model.PostProcess.checkOutputs(model, outputs)
+		if err != nil {
+			return "", err
+		}
 	}
 
-	log.Printf("checking if %s is authorized to run model %s", userID, name)
+	if !model.isActive() {
+		return "", fmt.Errorf("model %s is retired", name)
+	}
 
-	var predictions *tensorflow.Tensor
+	log.Printf("checking if %s is authorized to run model %s", userID, name)
 
 	response := ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("GetPrices")}, ctx.GetStub().GetChannelID())
 	log.Printf("status code: %d\n, payload: %s\n, message: %s", response.Status, string(response.Payload), response.Message)
@@ -228,38 +363,83 @@ func (sc *SmartContract) RunModel(ctx CustomTransactionContextInterface, name st
 	if err != nil {
 		return "", err
 	}
+	if user.Role == "unauthorized_user" {
+		return "", fmt.Errorf("user %s not authorized by admin", userID)
+	}
+
+	license, err := checkLicense(ctx, model, userID)
+	if err != nil {
+		return "", err
+	}
+
+	price := prices.batchPrice(count)
 
 	if userID == model.Creator {
-		if user.Balance < prices.Use {
-			return "", fmt.Errorf("insufficient funds. balance: %d\nprice: %d", user.Balance, prices.Use)
+		if user.Balance < price {
+			return "", fmt.Errorf("insufficient funds. balance: %d\nprice: %d", user.Balance, price)
 		}
 
 	} else {
-		if !model.isAllowed(userID) {
-			return "", errors.New("user not allowed to run model")
-		}
-		if user.Balance < prices.Use*2 {
-			return "", fmt.Errorf("insufficient funds. balance: %d\nprice: %d", user.Balance, prices.Use)
+		if user.Balance < price*2 {
+			return "", fmt.Errorf("insufficient funds. balance: %d\nprice: %d", user.Balance, price)
 		}
 	}
-	predictions, err = model.execute(decodedInput)
+
+	// decodifica degli input, scaricamento e verifica dei file solo dopo i controlli, così chi non
+	// può eseguire il modello non può far decodificare immagini o ricalcolare l'hash dell'archivio ai peer
+	decodedInputs, err := decodeInputs(items, model)
+	if err != nil {
+		return "", err
+	}
+
+	err = ensureModelFiles(model)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkIntegrity(model)
+	if err != nil {
+		return "", err
+	}
+
+	predictions, err := model.execute(decodedInputs, outputs, count)
 
 	if err != nil {
 		return "", fmt.Errorf("error executing model: %s", err)
 	}
-	response = ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("PayForModel"), []byte(model.Creator), []byte(model.Name)}, ctx.GetStub().GetChannelID())
+	if count == 1 {
+		response = ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("PayForModel"), []byte(model.Creator), []byte(model.Name)}, ctx.GetStub().GetChannelID())
+	} else {
+		response = ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("PayForBatch"), []byte(model.Creator), []byte(model.Name), []byte(strconv.Itoa(count))}, ctx.GetStub().GetChannelID())
+	}
 
 	log.Printf("status code: %d\n, payload: %s\n, message: %s", response.Status, string(response.Payload), response.Message)
 	if response.Status == 500 {
 		return "", fmt.Errorf("error during payment: %s", response.Message)
 	}
 
+	err = useLicense(ctx, license, count)
+	if err != nil {
+		return "", err
+	}
+
+	// il creatore che esegue il proprio modello paga solo l'amministratore
+	earned := price
+	if userID == model.Creator {
+		earned = 0
+	}
+	err = recordUsage(ctx, model, userID, UsageRun, count, earned)
+	if err != nil {
+		return "", fmt.Errorf("error recording usage: %s", err)
+	}
+
 	event := ModelUse{
 		Creator: model.Creator,
 		Model:   model.Name,
 		Hash:    model.Hash,
-		Price:   prices.Use,
+		Price:   price,
 		User:    userID,
+		Batch:   count,
 	}
 	eventJSON, err := json.Marshal(event)
 	if err != nil {
@@ -269,33 +449,7 @@ func (sc *SmartContract) RunModel(ctx CustomTransactionContextInterface, name st
 	if err != nil {
 		return "", fmt.Errorf("error setting event: %v", err)
 	}
-	return fmt.Sprintf("%v", predictions.Value()), nil
-}
-
-func modelsFromIterator(iterator shim.StateQueryIteratorInterface) ([]*ModelResult, error) {
-	var models []*ModelResult
-
-	for iterator.HasNext() {
-		m, err := iterator.Next()
-
-		if err != nil {
-			return nil, err
-		}
-
-		var model Model
-		err = json.Unmarshal(m.Value, &model)
-		if err != nil {
-			return nil, err
-		}
-		result := ModelResult{
-			Name:   model.Name,
-			Input:  model.Input,
-			Output: model.Output,
-		}
-		models = append(models, &result)
-
-	}
-	return models, nil
+	return runResult(model, predictions, outputs, count, format)
 }
 
 func (sc *SmartContract) GetAllModels(ctx CustomTransactionContextInterface) ([]*ModelResult, error) {
@@ -316,76 +470,16 @@ func (sc *SmartContract) GetAllModels(ctx CustomTransactionContextInterface) ([]
 			return nil, fmt.Errorf("error reading iterator: %s", err)
 		}
 
-		var model Model
-		err = json.Unmarshal(m.Value, &model)
+		model, err := modelFromBytes(m.Value)
 		if err != nil {
 			return nil, fmt.Errorf("error unmarshaling: %s", err)
 		}
-		r := ModelResult{
-			Name:   model.Name,
-			Input:  model.Input,
-			Output: model.Output,
-		}
-		models = append(models, &r)
+		models = append(models, model.result())
 	}
 	return models, nil
 }
 
-func (sc *SmartContract) GetModelsByDev(ctx CustomTransactionContextInterface, username string) ([]*ModelResult, error) {
-	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey("byDev", []string{username})
-
-	if err != nil {
-		return nil, err
-	}
-	return modelsFromIterator(iterator)
-}
+// concede all'utente id una licenza senza scadenza e senza limite di esecuzioni
 func (sc *SmartContract) Authorize(ctx CustomTransactionContextInterface, modelID string, id string) error {
-
-	existing := ctx.GetData()
-
-	if existing == nil {
-		return fmt.Errorf("no model %s exists", modelID)
-	}
-
-	result := ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("GetUserInfo"), []byte(id)}, ctx.GetStub().GetChannelID())
-	if result.Status == 500 {
-		return fmt.Errorf("error invoking chaincode: %s", result.Message)
-	}
-	userToAuthorize := new(UserInfo)
-	err := json.Unmarshal(result.Payload, userToAuthorize)
-	if err != nil {
-		return fmt.Errorf("")
-	}
-	if userToAuthorize.Role == "unauthorized_user" {
-		return fmt.Errorf("user %s not authorized by admin", id)
-	}
-	var model Model
-
-	err = json.Unmarshal(existing, &model)
-
-	if err != nil {
-		return err
-	}
-
-	userId, err := ctx.GetClientIdentity().GetID()
-
-	if err != nil {
-		return err
-	}
-
-	if userId != model.Creator {
-		return fmt.Errorf("you aren't the owner of the model")
-	}
-
-	err = model.authorize(id)
-
-	if err != nil {
-		return err
-	}
-
-	modelBytes, err := json.Marshal(model)
-	if err != nil {
-		return err
-	}
-	return ctx.GetStub().PutState(modelID, modelBytes)
+	return sc.GrantLicense(ctx, modelID, id, 0, 0)
 }
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+
+	"chaincode/modelhash"
+)
+
+// identità serializzata con un certificato autofirmato, come quella che il peer passa al chaincode
+func testCreator(t *testing.T, mspID string, name string) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creator, err := proto.Marshal(&msp.SerializedIdentity{
+		Mspid:   mspID,
+		IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return creator
+}
+
+// stub in memoria con il comportamento del peer che MockStub non riproduce: le range query
+// con chiave iniziale vuota escludono le chiavi composte e le query paginate restituiscono risultati
+type testStub struct {
+	*shimtest.MockStub
+	cc   shim.Chaincode
+	args [][]byte
+}
+
+// chaincode configurato come in main
+func newTestStub(t *testing.T) *testStub {
+	t.Helper()
+	sc := new(SmartContract)
+	sc.TransactionContextHandler = new(CustomTransactionContext)
+	sc.UnknownTransaction = UnknownTransactionHandler
+	sc.BeforeTransaction = LoadEntities
+
+	cc, err := contractapi.NewChaincode(sc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &testStub{MockStub: shimtest.NewMockStub("models", cc), cc: cc}
+	stub.Creator = testCreator(t, "Org1MSP", "user1")
+	return stub
+}
+
+func (s *testStub) GetArgs() [][]byte {
+	return s.args
+}
+
+func (s *testStub) GetStringArgs() []string {
+	var args []string
+	for _, arg := range s.args {
+		args = append(args, string(arg))
+	}
+	return args
+}
+
+func (s *testStub) GetFunctionAndParameters() (string, []string) {
+	args := s.GetStringArgs()
+	if len(args) == 0 {
+		return "", nil
+	}
+	return args[0], args[1:]
+}
+
+func (s *testStub) GetStateByRange(startKey string, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	if endKey == "" {
+		endKey = string(utf8.MaxRune)
+	}
+	return s.MockStub.GetStateByRange(startKey, endKey)
+}
+
+func (s *testStub) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	iterator, err := s.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iterator.Close()
+
+	page := new(sliceIterator)
+	next := ""
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, nil, err
+		}
+		if bookmark != "" && entry.Key < bookmark {
+			continue
+		}
+		if len(page.entries) == int(pageSize) {
+			next = entry.Key
+			break
+		}
+		page.entries = append(page.entries, entry)
+	}
+	return page, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.entries)), Bookmark: next}, nil
+}
+
+// rich query come CouchDB: il selettore è valutato su tutti i documenti, comprese le chiavi composte,
+// con la chiave nel campo _id. la paginazione non è considerata
+func (s *testStub) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	q, err := parseSelector(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	page := new(sliceIterator)
+	for element := s.Keys.Front(); element != nil; element = element.Next() {
+		key := element.Value.(string)
+		var doc map[string]interface{}
+		if json.Unmarshal(s.State[key], &doc) != nil {
+			continue
+		}
+		doc["_id"] = key
+		ok, err := q.match(doc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			page.entries = append(page.entries, &queryresult.KV{Key: key, Value: s.State[key]})
+		}
+	}
+	return page, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(len(page.entries))}, nil
+}
+
+type sliceIterator struct {
+	entries []*queryresult.KV
+}
+
+func (it *sliceIterator) HasNext() bool {
+	return len(it.entries) > 0
+}
+
+func (it *sliceIterator) Next() (*queryresult.KV, error) {
+	entry := it.entries[0]
+	it.entries = it.entries[1:]
+	return entry, nil
+}
+
+func (it *sliceIterator) Close() error {
+	return nil
+}
+
+// scrive il modello e i suoi indici come SaveModel, senza scaricare i file
+func putTestModel(t *testing.T, stub *testStub, model *Model) {
+	t.Helper()
+	ctx := new(CustomTransactionContext)
+	ctx.SetStub(stub)
+	stub.MockTransactionStart("put " + model.Name)
+	err := NewModelRepository(ctx).Create(model)
+	stub.MockTransactionEnd("put " + model.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// identificativo del chiamante come lo restituisce GetClientIdentity().GetID()
+func testClientID(t *testing.T, stub *testStub) string {
+	t.Helper()
+	identity, err := cid.New(stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := identity.GetID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func invoke(stub *testStub, fcn string, args ...string) pb.Response {
+	stub.args = [][]byte{[]byte(fcn)}
+	for _, arg := range args {
+		stub.args = append(stub.args, []byte(arg))
+	}
+	stub.MockTransactionStart("tx")
+	defer stub.MockTransactionEnd("tx")
+	return stub.cc.Invoke(stub)
+}
+
+// modello come lo registra SaveModel: senza tag, piani, conversioni né post-elaborazione
+func testModel(name string) *Model {
+	return &Model{
+		Id:           "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH",
+		Name:         name,
+		Hash:         "34312174686ce443db57c7fda1233d8a4615dd0ac30168116fcf35fee068e0ba",
+		HashScheme:   1,
+		Location:     "models/QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH",
+		Source:       "ipfs://QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH",
+		Inputs:       []Data{{Key: "x", Name: "serving_default_x", Shape: []int64{-1, 4}, Idx: 0}},
+		Outputs:      []Data{{Key: "y", Name: "StatefulPartitionedCall", Shape: []int64{-1, 3}, Idx: 0}},
+		Creator:      "creator",
+		AllowedUsers: []string{"creator"},
+		Status:       StatusActive,
+		AccessPolicy: AccessApproval,
+		Metadata:     &ModelMetadata{Framework: "tensorflow", FrameworkVersion: "2.5.0"},
+	}
+}
+
+// i valori restituiti dalle transazioni sono validati rispetto allo schema dei metadati del contratto
+func TestGetModelSchema(t *testing.T) {
+	stub := newTestStub(t)
+	putTestModel(t, stub, testModel("plain"))
+
+	full := testModel("full")
+	full.Pinned = true
+	full.Tags = []string{"vision"}
+	full.Plans = map[string]LicensePlan{"monthly": {Price: 10, Duration: 30 * 24 * 3600}}
+	full.PostProcess = &PostProcess{Softmax: true, TopK: 1}
+	full.Preprocess = map[string]*Preprocess{"x": {Type: PreprocessImage, Width: 2, Height: 2, Channels: 1}}
+	full.Metadata.Description = "test model"
+	full.Metadata.Metrics = map[string]float64{"accuracy": 0.9}
+	putTestModel(t, stub, full)
+
+	for _, name := range []string{"plain", "full"} {
+		response := invoke(stub, "GetModel", name)
+		if response.Status != 200 {
+			t.Fatalf("GetModel %s: %d %s", name, response.Status, response.Message)
+		}
+		result := new(ModelResult)
+		err := json.Unmarshal(response.Payload, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Name != name || result.Hash != full.Hash {
+			t.Fatalf("GetModel %s returned %s", name, response.Payload)
+		}
+	}
+
+	response := invoke(stub, "GetAllModels")
+	if response.Status != 200 {
+		t.Fatalf("GetAllModels: %d %s", response.Status, response.Message)
+	}
+	var all []*ModelResult
+	err := json.Unmarshal(response.Payload, &all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("GetAllModels returned %s", response.Payload)
+	}
+}
+
+// recensione senza commento, letta con ListReviews
+func TestListReviewsSchema(t *testing.T) {
+	stub := newTestStub(t)
+	model := testModel("reviewed")
+	putTestModel(t, stub, model)
+
+	stub.MockTransactionStart("review")
+	key, err := stub.CreateCompositeKey(reviewPrefix, []string{model.Name, model.Hash, "user1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reviewBytes, err := json.Marshal(Review{Model: model.Name, Version: model.Hash, User: "user1", Stars: 4, Timestamp: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stub.PutState(key, reviewBytes)
+	stub.MockTransactionEnd("review")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := invoke(stub, "ListReviews", model.Name, "", "10", "")
+	if response.Status != 200 {
+		t.Fatalf("ListReviews: %d %s", response.Status, response.Message)
+	}
+	page := new(ReviewPage)
+	err = json.Unmarshal(response.Payload, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Reviews) != 1 || page.Reviews[0].Stars != 4 {
+		t.Fatalf("ListReviews returned %s", response.Payload)
+	}
+}
+
+// verifica completa di un modello integro e di uno modificato sul disco
+func TestVerifyModelSchema(t *testing.T) {
+	stub := newTestStub(t)
+	dir := filepath.Join(t.TempDir(), "model")
+	err := os.MkdirAll(filepath.Join(dir, "variables"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "saved_model.pb"), []byte("graph"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	model := testModel("verified")
+	model.Location = dir
+	model.Hash, err = modelhash.HashDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	model.Manifest, _, err = buildManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestModel(t, stub, model)
+
+	verify := func() *VerifyResult {
+		response := invoke(stub, "VerifyModel", model.Name)
+		if response.Status != 200 {
+			t.Fatalf("VerifyModel: %d %s", response.Status, response.Message)
+		}
+		result := new(VerifyResult)
+		err := json.Unmarshal(response.Payload, result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	if result := verify(); !result.Valid || len(result.Mismatches) != 0 {
+		t.Fatalf("intact model reported as %+v", result)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "saved_model.pb"), []byte("graph!"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result := verify(); result.Valid || len(result.Mismatches) == 0 {
+		t.Fatalf("modified model reported as %+v", result)
+	}
+}
+
+// statistiche e guadagni senza limiti di data, con from e to vuoti
+func TestStatsUnboundedRange(t *testing.T) {
+	stub := newTestStub(t)
+	model := testModel("used")
+	model.Creator = testClientID(t, stub)
+	putTestModel(t, stub, model)
+
+	ctx := new(CustomTransactionContext)
+	ctx.SetStub(stub)
+	stub.MockTransactionStart("run")
+	err := recordUsage(ctx, model, "user2", UsageRun, 2, 10)
+	stub.MockTransactionEnd("run")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := invoke(stub, "GetModelStats", model.Name, "", "")
+	if response.Status != 200 {
+		t.Fatalf("GetModelStats: %d %s", response.Status, response.Message)
+	}
+	stats := new(ModelStats)
+	err = json.Unmarshal(response.Payload, stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Calls != 1 || stats.Runs != 2 || stats.Earned != 10 || len(stats.Days) != 1 {
+		t.Fatalf("GetModelStats returned %s", response.Payload)
+	}
+
+	response = invoke(stub, "GetCreatorEarnings", "", "", "")
+	if response.Status != 200 {
+		t.Fatalf("GetCreatorEarnings: %d %s", response.Status, response.Message)
+	}
+	earnings := new(CreatorEarnings)
+	err = json.Unmarshal(response.Payload, earnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if earnings.Total != 10 || earnings.Models[model.Name] != 10 {
+		t.Fatalf("GetCreatorEarnings returned %s", response.Payload)
+	}
+}
+
+// sincronizzazione eseguita dall'amministratore con i file del modello già presenti
+func TestSyncModelsSchema(t *testing.T) {
+	stub := newTestStub(t)
+	stub.Creator = testCreator(t, "Org2MSP", "admin")
+
+	model := testModel("synced")
+	model.Location = t.TempDir()
+	putTestModel(t, stub, model)
+
+	response := invoke(stub, "SyncModels")
+	if response.Status != 200 {
+		t.Fatalf("SyncModels: %d %s", response.Status, response.Message)
+	}
+	var results []SyncResult
+	err := json.Unmarshal(response.Payload, &results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Model != model.Name || results[0].Error != "" {
+		t.Fatalf("SyncModels returned %s", response.Payload)
+	}
+}
+
+// le voci byDev scritte prima di ModelRepository contengono una copia completa del modello
+func TestQueryModelsSkipsCompositeKeys(t *testing.T) {
+	stub := newTestStub(t)
+	model := testModel("legacy")
+	putTestModel(t, stub, model)
+
+	stub.MockTransactionStart("legacy index")
+	key, err := stub.CreateCompositeKey(devIndex, []string{model.Creator, model.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modelBytes, err := json.Marshal(model)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stub.PutState(key, modelBytes)
+	stub.MockTransactionEnd("legacy index")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response := invoke(stub, "QueryModels", `{"name": "legacy"}`, "10", "")
+	if response.Status != 200 {
+		t.Fatalf("QueryModels: %d %s", response.Status, response.Message)
+	}
+	page := new(ModelQueryPage)
+	err = json.Unmarshal(response.Payload, page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Models) != 1 {
+		t.Fatalf("QueryModels returned %s", response.Payload)
+	}
+}
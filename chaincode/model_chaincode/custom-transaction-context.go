@@ -4,19 +4,20 @@ import "github.com/hyperledger/fabric-contract-api-go/contractapi"
 
 type CustomTransactionContext struct {
 	contractapi.TransactionContext
-	data []byte
+	model *Model
 }
 
 type CustomTransactionContextInterface interface {
 	contractapi.TransactionContextInterface
-	GetData() []byte
-	SetData([]byte)
+	Model() *Model
+	SetModel(*Model)
 }
 
-func (ctc *CustomTransactionContext) GetData() []byte {
-	return ctc.data
+// modello caricato da LoadEntities secondo le dichiarazioni della transazione
+func (ctc *CustomTransactionContext) Model() *Model {
+	return ctc.model
 }
 
-func (ctc *CustomTransactionContext) SetData(data []byte) {
-	ctc.data = data
+func (ctc *CustomTransactionContext) SetModel(model *Model) {
+	ctc.model = model
 }
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// regole per l'estrazione degli archivi dei modelli. MaxBytes limita la dimensione
+// totale dei file estratti e MaxEntries il numero di voci dell'archivio
+type ExtractPolicy struct {
+	AllowSymlinks  bool
+	AllowHardlinks bool
+	MaxBytes       int64
+	MaxEntries     int
+}
+
+var defaultExtractPolicy = ExtractPolicy{
+	AllowSymlinks:  os.Getenv("MODEL_ALLOW_SYMLINKS") == "true",
+	AllowHardlinks: os.Getenv("MODEL_ALLOW_HARDLINKS") == "true",
+	MaxBytes:       int64(envInt("MODEL_MAX_MB", 1024)) << 20,
+	MaxEntries:     envInt("MODEL_MAX_ENTRIES", 10000),
+}
+
+// percorso della voce relativo alla radice dell'archivio, rifiuta percorsi assoluti
+// e percorsi che escono dalla radice
+func entryPath(name string) (string, error) {
+	if path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("absolute path %s in archive", name)
+	}
+	clean := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("path %s escapes the archive root", name)
+	}
+	return clean, nil
+}
+
+// crea le directory che contengono la voce name e ne restituisce il percorso in root.
+// rifiuta la voce se una delle directory è un link simbolico estratto in precedenza:
+// i controlli su name riguardano solo il testo e un link come a -> . seguito da a/b -> ..
+// porterebbe le voci successive fuori dalla radice
+func entryDest(root string, name string) (string, error) {
+	dir := root
+	parts := strings.Split(name, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			err = os.Mkdir(dir, 0755)
+			if err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent of %s is not a directory in archive", name)
+		}
+	}
+	return filepath.Join(dir, parts[len(parts)-1]), nil
+}
+
+// estrae il file tar.gz contenente il modello in target. l'archivio viene estratto in una
+// directory temporanea accanto a target, che viene poi rinominata in target
+func Untar(r io.Reader, target string, policy ExtractPolicy) error {
+	tmp, err := extractTemp(r, target, policy)
+	if err != nil {
+		return err
+	}
+	return installDir(tmp, target)
+}
+
+// estrae l'archivio in una directory temporanea accanto a target e ne restituisce il percorso
+func extractTemp(r io.Reader, target string, policy ExtractPolicy) (string, error) {
+	parent := filepath.Dir(filepath.Clean(target))
+	err := os.MkdirAll(parent, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	tmp, err := os.MkdirTemp(parent, ".extract-")
+	if err != nil {
+		return "", err
+	}
+
+	err = extract(r, tmp, policy)
+	if err == nil {
+		err = drain(r, policy.MaxBytes)
+	}
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// legge il resto del flusso, così le verifiche del contenuto scaricato arrivano alla fine.
+// i dati dopo la fine dell'archivio non possono superare il limite dell'estrazione
+func drain(r io.Reader, limit int64) error {
+	if limit <= 0 {
+		_, err := io.Copy(io.Discard, r)
+		return err
+	}
+	n, err := io.Copy(io.Discard, io.LimitReader(r, limit+1))
+	if err != nil {
+		return err
+	}
+	if n > limit {
+		return fmt.Errorf("archive exceeds the limit of %d bytes", limit)
+	}
+	return nil
+}
+
+// sposta la directory estratta in target con il lock esclusivo sulla directory del modello
+func installDir(tmp string, target string) error {
+	lock, err := lockModelDir(target, true)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	defer lock.unlock()
+
+	err = replaceDir(tmp, target)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	return nil
+}
+
+// sostituisce target con src. se target esiste viene spostato e rimosso dopo la rinomina
+func replaceDir(src string, target string) error {
+	_, err := os.Stat(target)
+	if os.IsNotExist(err) {
+		return os.Rename(src, target)
+	}
+	if err != nil {
+		return err
+	}
+
+	old := src + ".old"
+	err = os.Rename(target, old)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, target)
+	if err != nil {
+		os.Rename(old, target)
+		return err
+	}
+	return os.RemoveAll(old)
+}
+
+func extract(r io.Reader, root string, policy ExtractPolicy) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	defer gzr.Close()
+
+	tarReader := tar.NewReader(gzr)
+
+	var total int64
+	entries := 0
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		entries++
+		if policy.MaxEntries > 0 && entries > policy.MaxEntries {
+			return fmt.Errorf("archive has more than %d entries", policy.MaxEntries)
+		}
+
+		name, err := entryPath(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		dest, err := entryDest(root, name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(dest, 0755)
+			if os.IsExist(err) {
+				info, statErr := os.Lstat(dest)
+				if statErr == nil && info.IsDir() {
+					err = nil
+				} else {
+					err = fmt.Errorf("%s already exists in archive", header.Name)
+				}
+			}
+
+		case tar.TypeReg:
+			if header.Size < 0 || policy.MaxBytes > 0 && total+header.Size > policy.MaxBytes {
+				return fmt.Errorf("archive exceeds the limit of %d bytes", policy.MaxBytes)
+			}
+			var n int64
+			n, err = writeFile(dest, tarReader, header)
+			total += n
+
+		case tar.TypeSymlink:
+			if !policy.AllowSymlinks {
+				return fmt.Errorf("symlink %s not allowed", header.Name)
+			}
+			// il link deve puntare all'interno dell'archivio
+			_, err = entryPath(path.Join(path.Dir(name), header.Linkname))
+			if err != nil || path.IsAbs(header.Linkname) {
+				return fmt.Errorf("symlink %s points outside the archive: %s", header.Name, header.Linkname)
+			}
+			err = os.Symlink(header.Linkname, dest)
+
+		case tar.TypeLink:
+			if !policy.AllowHardlinks {
+				return fmt.Errorf("hard link %s not allowed", header.Name)
+			}
+			var linkname string
+			linkname, err = entryPath(header.Linkname)
+			if err != nil {
+				return err
+			}
+			source, statErr := entryDest(root, linkname)
+			var info os.FileInfo
+			if statErr == nil {
+				info, statErr = os.Lstat(source)
+			}
+			if statErr != nil || !info.Mode().IsRegular() {
+				return fmt.Errorf("hard link %s to unknown file %s", header.Name, header.Linkname)
+			}
+			err = os.Link(source, dest)
+
+		default:
+			return fmt.Errorf("unsupported entry %s of type %c", header.Name, header.Typeflag)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scrive un file dell'archivio senza superare la dimensione dichiarata nell'header
+func writeFile(dest string, r io.Reader, header *tar.Header) (int64, error) {
+	// un link simbolico già estratto non deve essere seguito
+	if info, err := os.Lstat(dest); err == nil && !info.Mode().IsRegular() {
+		return 0, fmt.Errorf("%s already exists in archive", header.Name)
+	}
+
+	file, err := os.OpenFile(dest, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, os.FileMode(header.Mode)&0755|0600)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(file, io.LimitReader(r, header.Size))
+	closeErr := file.Close()
+	if err != nil {
+		return n, err
+	}
+	if n != header.Size {
+		return n, fmt.Errorf("truncated entry %s", header.Name)
+	}
+	return n, closeErr
+}
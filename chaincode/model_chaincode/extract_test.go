@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// voce di un archivio di prova
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+func buildArchive(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		if e.typeflag == tar.TypeReg {
+			header.Size = int64(len(e.body))
+		}
+		if e.typeflag == tar.TypeDir {
+			header.Mode = 0755
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractPolicy(t *testing.T) {
+	links := ExtractPolicy{AllowSymlinks: true, AllowHardlinks: true}
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		policy  ExtractPolicy
+		wantErr string
+	}{
+		{
+			name:    "regular files",
+			entries: []tarEntry{{name: "saved_model.pb", typeflag: tar.TypeReg, body: "pb"}, {name: "variables/", typeflag: tar.TypeDir}, {name: "variables/data", typeflag: tar.TypeReg, body: "data"}},
+		},
+		{
+			name:    "parent path",
+			entries: []tarEntry{{name: "../x", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: "escapes the archive root",
+		},
+		{
+			name:    "nested parent path",
+			entries: []tarEntry{{name: "a/../../x", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: "escapes the archive root",
+		},
+		{
+			name:    "absolute path",
+			entries: []tarEntry{{name: "/tmp/x", typeflag: tar.TypeReg, body: "x"}},
+			wantErr: "absolute path",
+		},
+		{
+			name:    "symlink not allowed",
+			entries: []tarEntry{{name: "l", typeflag: tar.TypeSymlink, linkname: "saved_model.pb"}},
+			wantErr: "not allowed",
+		},
+		{
+			name:    "symlink inside the archive",
+			entries: []tarEntry{{name: "saved_model.pb", typeflag: tar.TypeReg, body: "pb"}, {name: "l", typeflag: tar.TypeSymlink, linkname: "saved_model.pb"}},
+			policy:  links,
+		},
+		{
+			name:    "symlink outside the archive",
+			entries: []tarEntry{{name: "a/l", typeflag: tar.TypeSymlink, linkname: "../../x"}},
+			policy:  links,
+			wantErr: "points outside the archive",
+		},
+		{
+			name:    "absolute symlink",
+			entries: []tarEntry{{name: "l", typeflag: tar.TypeSymlink, linkname: "/etc/passwd"}},
+			policy:  links,
+			wantErr: "points outside the archive",
+		},
+		{
+			name: "symlink chain",
+			entries: []tarEntry{
+				{name: "a", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "a/b", typeflag: tar.TypeSymlink, linkname: ".."},
+				{name: "a/b/x", typeflag: tar.TypeReg, body: "escaped"},
+			},
+			policy:  links,
+			wantErr: "not a directory",
+		},
+		{
+			name: "file through a symlinked directory",
+			entries: []tarEntry{
+				{name: "d/", typeflag: tar.TypeDir},
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "d"},
+				{name: "l/x", typeflag: tar.TypeReg, body: "x"},
+			},
+			policy:  links,
+			wantErr: "not a directory",
+		},
+		{
+			name: "file over a symlink",
+			entries: []tarEntry{
+				{name: "saved_model.pb", typeflag: tar.TypeReg, body: "pb"},
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "saved_model.pb"},
+				{name: "l", typeflag: tar.TypeReg, body: "x"},
+			},
+			policy:  links,
+			wantErr: "already exists",
+		},
+		{
+			name: "directory over a symlink",
+			entries: []tarEntry{
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "l/", typeflag: tar.TypeDir},
+			},
+			policy:  links,
+			wantErr: "already exists",
+		},
+		{
+			name:    "hardlink not allowed",
+			entries: []tarEntry{{name: "saved_model.pb", typeflag: tar.TypeReg, body: "pb"}, {name: "h", typeflag: tar.TypeLink, linkname: "saved_model.pb"}},
+			wantErr: "not allowed",
+		},
+		{
+			name:    "hardlink inside the archive",
+			entries: []tarEntry{{name: "saved_model.pb", typeflag: tar.TypeReg, body: "pb"}, {name: "h", typeflag: tar.TypeLink, linkname: "saved_model.pb"}},
+			policy:  links,
+		},
+		{
+			name:    "hardlink outside the archive",
+			entries: []tarEntry{{name: "h", typeflag: tar.TypeLink, linkname: "../x"}},
+			policy:  links,
+			wantErr: "escapes the archive root",
+		},
+		{
+			name: "hardlink through a symlink",
+			entries: []tarEntry{
+				{name: "l", typeflag: tar.TypeSymlink, linkname: "."},
+				{name: "h", typeflag: tar.TypeLink, linkname: "l/h"},
+			},
+			policy:  links,
+			wantErr: "unknown file",
+		},
+		{
+			name:    "size limit",
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg, body: "12345"}, {name: "b", typeflag: tar.TypeReg, body: "67890"}},
+			policy:  ExtractPolicy{MaxBytes: 8},
+			wantErr: "exceeds the limit",
+		},
+		{
+			name:    "entry limit",
+			entries: []tarEntry{{name: "a", typeflag: tar.TypeReg}, {name: "b", typeflag: tar.TypeReg}, {name: "c", typeflag: tar.TypeReg}},
+			policy:  ExtractPolicy{MaxEntries: 2},
+			wantErr: "more than 2 entries",
+		},
+		{
+			name:    "unsupported entry",
+			entries: []tarEntry{{name: "fifo", typeflag: tar.TypeFifo}},
+			wantErr: "unsupported entry",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base := t.TempDir()
+			target := filepath.Join(base, "models", "model")
+			archive := buildArchive(t, test.entries)
+
+			tmp, err := extractTemp(bytes.NewReader(archive), target, test.policy)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				os.RemoveAll(tmp)
+			} else if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", test.wantErr, err)
+			}
+
+			// niente deve essere scritto fuori dalla directory temporanea
+			outside, err := os.ReadDir(filepath.Join(base, "models"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(outside) != 0 {
+				t.Fatalf("files left outside the extraction root: %v", outside)
+			}
+			if _, err := os.Lstat(filepath.Join(base, "x")); err == nil {
+				t.Fatal("file written outside the extraction root")
+			}
+		})
+	}
+}
+
+func TestExtractTrailingDataLimit(t *testing.T) {
+	archive := buildArchive(t, []tarEntry{{name: "a", typeflag: tar.TypeReg, body: "a"}})
+	policy := ExtractPolicy{MaxBytes: 1 << 10}
+	target := filepath.Join(t.TempDir(), "model")
+
+	// i dati dopo la fine dell'archivio non superano il limite
+	tmp, err := extractTemp(bytes.NewReader(append(archive, make([]byte, 512)...)), target, policy)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	os.RemoveAll(tmp)
+
+	_, err = extractTemp(bytes.NewReader(append(archive, make([]byte, 4<<10)...)), target, policy)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Fatalf("expected limit error, got %v", err)
+	}
+}
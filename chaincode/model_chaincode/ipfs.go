@@ -0,0 +1,285 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+
+	"github.com/ipfs/go-cid"
+	shell "github.com/ipfs/go-ipfs-api"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// parametri predefiniti di ipfs add: blocchi di 256 KiB e alberi bilanciati
+// con al massimo 174 figli per nodo
+const (
+	unixfsChunkSize = 256 * 1024
+	unixfsMaxLinks  = 174
+)
+
+// nodo dell'albero UnixFS: il CID del blocco, la dimensione dei dati del file
+// e quella cumulativa dei blocchi, usata nei link del nodo padre
+type unixfsNode struct {
+	cid       cid.Cid
+	fileSize  uint64
+	totalSize uint64
+}
+
+// ricalcola il CID dei dati letti, come ipfs add con le opzioni predefinite, e lo confronta
+// con quello dichiarato alla fine del flusso. i CID v0 usano foglie dag-pb, i CID v1 foglie raw
+type cidReader struct {
+	r        io.ReadCloser
+	expected cid.Cid
+	chunk    []byte
+	leaves   []unixfsNode
+}
+
+func newCIDReader(r io.ReadCloser, expected cid.Cid) (*cidReader, error) {
+	if expected.Prefix().MhType != mh.SHA2_256 {
+		return nil, fmt.Errorf("unsupported hash function in CID %s", expected)
+	}
+	if expected.Type() != cid.DagProtobuf && expected.Type() != cid.Raw {
+		return nil, fmt.Errorf("unsupported codec in CID %s", expected)
+	}
+	return &cidReader{r: r, expected: expected, chunk: make([]byte, 0, unixfsChunkSize)}, nil
+}
+
+func (c *cidReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	data := p[:n]
+	for len(data) > 0 {
+		free := unixfsChunkSize - len(c.chunk)
+		if free > len(data) {
+			free = len(data)
+		}
+		c.chunk = append(c.chunk, data[:free]...)
+		data = data[free:]
+		if len(c.chunk) == unixfsChunkSize {
+			c.addLeaf()
+		}
+	}
+	if err == io.EOF {
+		actual := c.root()
+		if !actual.Equals(c.expected) {
+			return n, fmt.Errorf("content CID %s doesn't match declared %s", actual, c.expected)
+		}
+	}
+	return n, err
+}
+
+func (c *cidReader) Close() error {
+	return c.r.Close()
+}
+
+func (c *cidReader) addLeaf() {
+	size := uint64(len(c.chunk))
+	if c.expected.Version() == 0 {
+		block := encodePBNode(nil, encodeUnixfsFile(c.chunk, size, nil))
+		c.leaves = append(c.leaves, unixfsNode{cid: blockCID(0, cid.DagProtobuf, block), fileSize: size, totalSize: uint64(len(block))})
+	} else {
+		c.leaves = append(c.leaves, unixfsNode{cid: blockCID(1, cid.Raw, c.chunk), fileSize: size, totalSize: size})
+	}
+	c.chunk = c.chunk[:0]
+}
+
+// radice dell'albero: un file vuoto o di un solo blocco è la foglia stessa,
+// altrimenti i nodi vengono raggruppati livello per livello
+func (c *cidReader) root() cid.Cid {
+	if len(c.chunk) > 0 || len(c.leaves) == 0 {
+		c.addLeaf()
+	}
+
+	nodes := c.leaves
+	for len(nodes) > 1 {
+		var parents []unixfsNode
+		for start := 0; start < len(nodes); start += unixfsMaxLinks {
+			end := start + unixfsMaxLinks
+			if end > len(nodes) {
+				end = len(nodes)
+			}
+			parents = append(parents, c.parent(nodes[start:end]))
+		}
+		nodes = parents
+	}
+	return nodes[0].cid
+}
+
+func (c *cidReader) parent(children []unixfsNode) unixfsNode {
+	var fileSize, childrenSize uint64
+	blockSizes := make([]uint64, len(children))
+	for i, child := range children {
+		fileSize += child.fileSize
+		childrenSize += child.totalSize
+		blockSizes[i] = child.fileSize
+	}
+	block := encodePBNode(children, encodeUnixfsFile(nil, fileSize, blockSizes))
+	return unixfsNode{
+		cid:       blockCID(c.expected.Version(), cid.DagProtobuf, block),
+		fileSize:  fileSize,
+		totalSize: uint64(len(block)) + childrenSize,
+	}
+}
+
+func blockCID(version uint64, codec uint64, block []byte) cid.Cid {
+	sum := sha256.Sum256(block)
+	hash, _ := mh.Encode(sum[:], mh.SHA2_256)
+	if version == 0 {
+		return cid.NewCidV0(hash)
+	}
+	return cid.NewCidV1(codec, hash)
+}
+
+// messaggio unixfs.Data di tipo File
+func encodeUnixfsFile(data []byte, fileSize uint64, blockSizes []uint64) []byte {
+	buf := appendVarintField(nil, 1, 2)
+	if len(data) > 0 {
+		buf = appendBytesField(buf, 2, data)
+	}
+	buf = appendVarintField(buf, 3, fileSize)
+	for _, size := range blockSizes {
+		buf = appendVarintField(buf, 4, size)
+	}
+	return buf
+}
+
+// nodo dag-pb nella forma canonica: prima i link, poi i dati
+func encodePBNode(links []unixfsNode, data []byte) []byte {
+	var buf []byte
+	for _, link := range links {
+		l := appendBytesField(nil, 1, link.cid.Bytes())
+		l = appendBytesField(l, 2, nil)
+		l = appendVarintField(l, 3, link.totalSize)
+		buf = appendBytesField(buf, 2, l)
+	}
+	return appendBytesField(buf, 1, data)
+}
+
+func appendVarint(buf []byte, v uint64) []byte {
+	for v >= 0x80 {
+		buf = append(buf, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(buf, byte(v))
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = appendVarint(buf, uint64(field)<<3)
+	return appendVarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, data []byte) []byte {
+	buf = appendVarint(buf, uint64(field)<<3|2)
+	buf = appendVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+func ipfsCID(location *url.URL) (cid.Cid, error) {
+	c, err := cid.Decode(location.Host + location.Path)
+	if err != nil {
+		return cid.Undef, fmt.Errorf("invalid CID %s: %s", location.Host+location.Path, err)
+	}
+	return c, nil
+}
+
+func (s *IPFSStore) shell() *shell.Shell {
+	sh := shell.NewShell(s.API)
+	sh.SetTimeout(s.Timeout)
+	return sh
+}
+
+func (s *IPFSStore) Pin(c cid.Cid) error {
+	return s.shell().Pin(c.String())
+}
+
+func (s *IPFSStore) Unpin(c cid.Cid) error {
+	return s.shell().Unpin(c.String())
+}
+
+// modello salvato su ipfs e relativo CID, per le operazioni di pin
+func getIPFSModel(ctx CustomTransactionContextInterface, name string) (*Model, cid.Cid, error) {
+	model := ctx.Model()
+
+	location, err := parseLocation(model.source())
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	if location.Scheme != "ipfs" {
+		return nil, cid.Undef, fmt.Errorf("model %s is not stored on ipfs", name)
+	}
+	c, err := ipfsCID(location)
+	if err != nil {
+		return nil, cid.Undef, err
+	}
+	return model, c, nil
+}
+
+// fissa l'archivio del modello sul nodo ipfs, perché non venga rimosso dalla garbage collection
+func (sc *SmartContract) PinModel(ctx CustomTransactionContextInterface, name string) error {
+	err := checkAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	model, c, err := getIPFSModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = ipfsStore.Pin(c)
+	if err != nil {
+		return fmt.Errorf("error pinning %s: %s", c, err)
+	}
+	log.Printf("pinned model %s (%s)", name, c)
+
+	model.Pinned = true
+	return NewModelRepository(ctx).Update(model)
+}
+
+func (sc *SmartContract) UnpinModel(ctx CustomTransactionContextInterface, name string) error {
+	err := checkAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	model, c, err := getIPFSModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = ipfsStore.Unpin(c)
+	if err != nil {
+		return fmt.Errorf("error unpinning %s: %s", c, err)
+	}
+	log.Printf("unpinned model %s (%s)", name, c)
+
+	model.Pinned = false
+	return NewModelRepository(ctx).Update(model)
+}
+
+type PinStatus struct {
+	Model string `json:"model"`
+	CID   string `json:"cid"`
+	// stato registrato nel world state e stato effettivo sul nodo ipfs di questo peer
+	Pinned     bool   `json:"pinned"`
+	NodePinned bool   `json:"node_pinned"`
+	PinType    string `json:"pin_type,omitempty" metadata:",optional"`
+}
+
+func (sc *SmartContract) GetPinStatus(ctx CustomTransactionContextInterface, name string) (*PinStatus, error) {
+	model, c, err := getIPFSModel(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	pins, err := ipfsStore.shell().Pins()
+	if err != nil {
+		return nil, fmt.Errorf("error reading pins: %s", err)
+	}
+
+	status := PinStatus{Model: name, CID: c.String(), Pinned: model.Pinned}
+	if info, exists := pins[c.String()]; exists {
+		status.NodePinned = true
+		status.PinType = info.Type
+	}
+	return &status, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/ipfs/go-cid"
+)
+
+// contenuto deterministico di n byte, lo stesso usato per generare i CID di riferimento
+func cidTestData(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i*31 + i/7)
+	}
+	return b
+}
+
+// CID calcolati con l'importer UnixFS di ipfs add (blocchi di 256 KiB, albero bilanciato,
+// 174 link per nodo): --cid-version=0 e --cid-version=1 --raw-leaves
+var cidKnownAnswers = []struct {
+	name string
+	size int
+	v0   string
+	v1   string
+}{
+	{"empty file", 0, "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH", "bafkreihdwdcefgh4dqkjv67uzcmw7ojee6xedzdetojuzjevtenxquvyku"},
+	{"one byte", 1, "QmS9JArPwa55ePgDnyg6TzX24mYTS1b1vLqWNebyVotKxQ", "bafkreidogqfzz75tpkmjzjke425xqcrmpcib2p5tg44hnbirumdbpl5adu"},
+	{"one chunk", unixfsChunkSize, "QmcNLu5asd7dMarigpaj1MHevBuugrvpQL8ynrQTJAvvft", "bafkreigwdzxeiwdylf5rf2r6pps3ysg35kyyutibufszpip43x5vvcrffa"},
+	{"one chunk plus one byte", unixfsChunkSize + 1, "QmaEzfaHCPmB8ht5ECZnwokMFH234WpAYF9nr7vQeCXT2f", "bafybeihcqauc2eyqrhvu2dzzsprjbmlsdvnlw5ahpsdtygaywc6vffxqyy"},
+	{"174 leaves", unixfsMaxLinks * unixfsChunkSize, "QmamPMYFrYg9W31KjBvPKLzUBti9vzZSDwiRGUxabGqVjx", "bafybeieffxczwrk4gdfleixjz5vb5uwbo3la6aw55oubnmndj5c746bsfa"},
+	{"175 leaves", unixfsMaxLinks*unixfsChunkSize + 1, "QmcqsWkAGNXfq8UZk5txQkaHQQaBhrqq9dv4uSi8qkJsTo", "bafybeie3ixkl34yx2ofrmfd752snvjelpvxi4a3m4gb2ghirxc7ecrsrle"},
+	{"176 leaves", (unixfsMaxLinks+1)*unixfsChunkSize + 1, "QmR9gtTcVHJXLRHTM7nC7dPpUR2ZDH4v1ns1uQj7YNui57", "bafybeic7j3ysxvpbz4tggn66vltbnjugmeb36bxcp57ra7glzxknfsn6ci"},
+}
+
+// lettore che restituisce i dati a blocchi di dimensione irregolare, per non allinearsi ai chunk
+type unevenReader struct {
+	data []byte
+	step int
+}
+
+func (u *unevenReader) Read(p []byte) (int, error) {
+	if len(u.data) == 0 {
+		return 0, io.EOF
+	}
+	u.step = u.step%7919 + 1
+	n := u.step
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(u.data) {
+		n = len(u.data)
+	}
+	copy(p, u.data[:n])
+	u.data = u.data[n:]
+	return n, nil
+}
+
+func readWithCID(data []byte, expected string) error {
+	c, err := cid.Decode(expected)
+	if err != nil {
+		return err
+	}
+	r, err := newCIDReader(io.NopCloser(&unevenReader{data: data}), c)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(io.Discard, r)
+	return err
+}
+
+func TestCIDReaderKnownAnswers(t *testing.T) {
+	for _, test := range cidKnownAnswers {
+		data := cidTestData(test.size)
+		for version, expected := range map[string]string{"v0": test.v0, "v1": test.v1} {
+			t.Run(test.name+" "+version, func(t *testing.T) {
+				err := readWithCID(data, expected)
+				if err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestCIDReaderMismatch(t *testing.T) {
+	data := cidTestData(unixfsChunkSize + 1)
+	// un byte modificato
+	data[len(data)/2] ^= 1
+	for _, expected := range []string{cidKnownAnswers[3].v0, cidKnownAnswers[3].v1} {
+		err := readWithCID(data, expected)
+		if err == nil || !strings.Contains(err.Error(), "doesn't match") {
+			t.Fatalf("expected mismatch for %s, got %v", expected, err)
+		}
+	}
+
+	// dati troncati
+	err := readWithCID(cidTestData(unixfsChunkSize), cidKnownAnswers[3].v0)
+	if err == nil {
+		t.Fatal("truncated data accepted")
+	}
+}
+
+func TestCIDReaderUnsupported(t *testing.T) {
+	// CID dag-cbor
+	c, err := cid.Decode("bafyreigbtj4x7ip5legnfznufuopl4sg4knzc2cof6duas4b3q2fy6swua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newCIDReader(io.NopCloser(bytes.NewReader(nil)), c)
+	if err == nil {
+		t.Fatal("dag-cbor CID accepted")
+	}
+}
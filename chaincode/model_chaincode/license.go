@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+)
+
+const licensePrefix = "license"
+
+// licenza di un utente per un modello. Expiry e MaxRuns a 0 indicano nessun limite
+type License struct {
+	Model   string `json:"model"`
+	User    string `json:"user"`
+	Start   int64  `json:"start"`
+	Expiry  int64  `json:"expiry"`
+	MaxRuns int    `json:"max_runs"`
+	Runs    int    `json:"runs"`
+	Revoked bool   `json:"revoked"`
+}
+
+// verifica che la licenza sia valida all'istante now
+func (l *License) check(now int64) error {
+	if l.Revoked {
+		return fmt.Errorf("license of %s for model %s has been revoked", l.User, l.Model)
+	}
+	if now < l.Start {
+		return fmt.Errorf("license of %s for model %s is valid from %d", l.User, l.Model, l.Start)
+	}
+	if l.Expiry != 0 && now >= l.Expiry {
+		return fmt.Errorf("license of %s for model %s expired at %d", l.User, l.Model, l.Expiry)
+	}
+	if l.MaxRuns != 0 && l.Runs >= l.MaxRuns {
+		return fmt.Errorf("license of %s for model %s exhausted: %d of %d runs used", l.User, l.Model, l.Runs, l.MaxRuns)
+	}
+	return nil
+}
+
+// piano di licenza messo in vendita dal creatore. Duration in secondi, 0 = nessun limite
+type LicensePlan struct {
+	Price    int   `json:"price"`
+	Duration int64 `json:"duration"`
+	MaxRuns  int   `json:"max_runs"`
+}
+
+func getLicense(ctx CustomTransactionContextInterface, model string, user string) (*License, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(licensePrefix, []string{model, user})
+	if err != nil {
+		return nil, err
+	}
+	licenseBytes, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	if licenseBytes == nil {
+		return nil, nil
+	}
+	license := new(License)
+	err = json.Unmarshal(licenseBytes, license)
+	if err != nil {
+		return nil, err
+	}
+	return license, nil
+}
+
+func putLicense(ctx CustomTransactionContextInterface, license *License) error {
+	key, err := ctx.GetStub().CreateCompositeKey(licensePrefix, []string{license.Model, license.User})
+	if err != nil {
+		return err
+	}
+	licenseBytes, err := json.Marshal(license)
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(key, licenseBytes)
+}
+
+// restituisce la licenza con cui userID può eseguire il modello.
+// il creatore non ha bisogno di licenza e per lui viene restituito nil
+func checkLicense(ctx CustomTransactionContextInterface, model *Model, userID string) (*License, error) {
+	if userID == model.Creator || model.accessPolicy() == AccessOpen {
+		return nil, nil
+	}
+
+	license, err := getLicense(ctx, model.Name, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if license == nil {
+		if model.isAllowed(userID) {
+			// autorizzazione precedente alle licenze: illimitata
+			return &License{Model: model.Name, User: userID}, nil
+		}
+		return nil, fmt.Errorf("user %s has no license for model %s", userID, model.Name)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	err = license.check(timestamp.GetSeconds())
+	if err != nil {
+		return nil, err
+	}
+	return license, nil
+}
+
+// licenza per user che parte dall'istante della transazione
+func newLicense(ctx CustomTransactionContextInterface, model *Model, user string, duration int64, maxRuns int) (*License, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return nil, err
+	}
+
+	license := License{
+		Model:   model.Name,
+		User:    user,
+		Start:   timestamp.GetSeconds(),
+		MaxRuns: maxRuns,
+	}
+	if duration != 0 {
+		license.Expiry = license.Start + duration
+	}
+	return &license, nil
+}
+
+// registra count esecuzioni sulla licenza
+func useLicense(ctx CustomTransactionContextInterface, license *License, count int) error {
+	if license == nil {
+		return nil
+	}
+	if license.MaxRuns != 0 && license.Runs+count > license.MaxRuns {
+		return fmt.Errorf("license of %s for model %s allows %d more runs, batch has %d items", license.User, license.Model, license.MaxRuns-license.Runs, count)
+	}
+	license.Runs += count
+	return putLicense(ctx, license)
+}
+
+// concede una licenza all'utente id per duration secondi (0 = senza scadenza) e maxRuns esecuzioni (0 = illimitate).
+// una licenza esistente viene sostituita
+func (sc *SmartContract) GrantLicense(ctx CustomTransactionContextInterface, modelID string, id string, duration int64, maxRuns int) error {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+
+	if duration < 0 || maxRuns < 0 {
+		return fmt.Errorf("duration and max runs can't be negative")
+	}
+
+	userToAuthorize, err := getUserInfo(ctx, id)
+	if err != nil {
+		return err
+	}
+	if userToAuthorize.Role == "unauthorized_user" {
+		return fmt.Errorf("user %s not authorized by admin", id)
+	}
+
+	license, err := newLicense(ctx, model, id, duration, maxRuns)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("granting license on model %s to %s: expiry %d, max runs %d", model.Name, id, license.Expiry, maxRuns)
+	return putLicense(ctx, license)
+}
+
+func (sc *SmartContract) RevokeAccess(ctx CustomTransactionContextInterface, modelID string, id string) error {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+
+	license, err := getLicense(ctx, model.Name, id)
+	if err != nil {
+		return err
+	}
+
+	if license == nil {
+		if !model.isAllowed(id) {
+			return fmt.Errorf("user %s has no license for model %s", id, model.Name)
+		}
+		license = &License{Model: model.Name, User: id}
+	}
+
+	if model.isAllowed(id) {
+		model.removeAllowed(id)
+		err = NewModelRepository(ctx).Update(model)
+		if err != nil {
+			return err
+		}
+	}
+
+	license.Revoked = true
+	return putLicense(ctx, license)
+}
+
+func (sc *SmartContract) ListLicensees(ctx CustomTransactionContextInterface, modelID string) ([]*License, error) {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(licensePrefix, []string{model.Name})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var licenses []*License
+	for iterator.HasNext() {
+		l, err := iterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		license := new(License)
+		err = json.Unmarshal(l.Value, license)
+		if err != nil {
+			return nil, err
+		}
+		licenses = append(licenses, license)
+	}
+	return licenses, nil
+}
+
+func (sc *SmartContract) SetAccessPolicy(ctx CustomTransactionContextInterface, modelID string, policy string) error {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+
+	switch policy {
+	case AccessOpen, AccessPaid, AccessApproval:
+	default:
+		return fmt.Errorf("unknown access policy %s", policy)
+	}
+
+	model.AccessPolicy = policy
+	return NewModelRepository(ctx).Update(model)
+}
+
+// aggiunge o sostituisce il piano di licenza plan del modello
+func (sc *SmartContract) SetLicensePlan(ctx CustomTransactionContextInterface, modelID string, plan string, price int, duration int64, maxRuns int) error {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+
+	if price < 0 || duration < 0 || maxRuns < 0 {
+		return fmt.Errorf("price, duration and max runs can't be negative")
+	}
+
+	if model.Plans == nil {
+		model.Plans = make(map[string]LicensePlan)
+	}
+	model.Plans[plan] = LicensePlan{Price: price, Duration: duration, MaxRuns: maxRuns}
+
+	return NewModelRepository(ctx).Update(model)
+}
+
+func (sc *SmartContract) RemoveLicensePlan(ctx CustomTransactionContextInterface, modelID string, plan string) error {
+	model, err := getOwnedModel(ctx, modelID)
+	if err != nil {
+		return err
+	}
+
+	if _, exists := model.Plans[plan]; !exists {
+		return fmt.Errorf("model %s has no plan %s", modelID, plan)
+	}
+	delete(model.Plans, plan)
+
+	return NewModelRepository(ctx).Update(model)
+}
+
+// acquisto di una licenza: il pagamento al creatore e la concessione avvengono nella stessa transazione
+func (sc *SmartContract) BuyLicense(ctx CustomTransactionContextInterface, modelID string, plan string) (*License, error) {
+	model := ctx.Model()
+
+	if !model.isActive() {
+		return nil, fmt.Errorf("model %s is retired", modelID)
+	}
+
+	if model.accessPolicy() != AccessPaid {
+		return nil, fmt.Errorf("licenses for model %s can't be bought. access policy: %s", modelID, model.accessPolicy())
+	}
+
+	licensePlan, exists := model.Plans[plan]
+	if !exists {
+		return nil, fmt.Errorf("model %s has no plan %s", modelID, plan)
+	}
+
+	userID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, err
+	}
+
+	if userID == model.Creator {
+		return nil, fmt.Errorf("the owner of model %s doesn't need a license", modelID)
+	}
+
+	current, err := getLicense(ctx, model.Name, userID)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && current.Revoked {
+		return nil, fmt.Errorf("license of %s for model %s has been revoked", userID, modelID)
+	}
+
+	// una licenza ancora valida, anche illimitata, verrebbe sostituita dal piano acquistato
+	// perdendo le esecuzioni e il tempo rimanenti: si può comprare solo quando è scaduta o esaurita
+	if current == nil && model.isAllowed(userID) {
+		return nil, fmt.Errorf("user %s is already authorized to run model %s", userID, modelID)
+	}
+	if current != nil {
+		timestamp, err := ctx.GetStub().GetTxTimestamp()
+		if err != nil {
+			return nil, err
+		}
+		if current.check(timestamp.GetSeconds()) == nil {
+			return nil, fmt.Errorf("user %s already has an active license for model %s", userID, modelID)
+		}
+	}
+
+	user, err := getUserInfo(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Role == "unauthorized_user" {
+		return nil, fmt.Errorf("user %s not authorized by admin", userID)
+	}
+	if user.Balance < licensePlan.Price {
+		return nil, fmt.Errorf("insufficient funds. balance: %d\nprice: %d", user.Balance, licensePlan.Price)
+	}
+
+	if licensePlan.Price > 0 {
+		response := ctx.GetStub().InvokeChaincode("tokens", [][]byte{[]byte("Transfer"), []byte(model.Creator), []byte(strconv.Itoa(licensePlan.Price))}, ctx.GetStub().GetChannelID())
+		log.Printf("status code: %d\n, payload: %s\n, message: %s", response.Status, string(response.Payload), response.Message)
+		if response.Status == 500 {
+			return nil, fmt.Errorf("error during payment: %s", response.Message)
+		}
+	}
+
+	license, err := newLicense(ctx, model, userID, licensePlan.Duration, licensePlan.MaxRuns)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordUsage(ctx, model, userID, UsageLicense, 0, licensePlan.Price)
+	if err != nil {
+		return nil, fmt.Errorf("error recording usage: %s", err)
+	}
+
+	log.Printf("%s bought plan %s of model %s for %d", userID, plan, modelID, licensePlan.Price)
+	return license, putLicense(ctx, license)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// legge il modello caricato da LoadEntities e verifica che il chiamante ne sia il proprietario
+func getOwnedModel(ctx CustomTransactionContextInterface, name string) (*Model, error) {
+	model := ctx.Model()
+
+	userID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return nil, err
+	}
+	if userID != model.Creator {
+		return nil, fmt.Errorf("you aren't the owner of the model")
+	}
+	return model, nil
+}
+
+// dati dei modelli con chiavi composte che iniziano con il nome del modello. le voci earnings
+// restano, sono lo storico dei guadagni del creatore
+var modelKeyPrefixes = []string{
+	licensePrefix,
+	usageIndex,
+	dayIndex(usageIndex),
+	callerIndex,
+	reviewPrefix,
+	ratingPrefix,
+}
+
+// elimina licenze, statistiche e recensioni del modello, che altrimenti passerebbero
+// a un nuovo modello salvato con lo stesso nome
+func deleteModelData(ctx CustomTransactionContextInterface, name string) error {
+	for _, prefix := range modelKeyPrefixes {
+		iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(prefix, []string{name})
+		if err != nil {
+			return err
+		}
+		var keys []string
+		for iterator.HasNext() {
+			entry, err := iterator.Next()
+			if err != nil {
+				iterator.Close()
+				return fmt.Errorf("error reading iterator: %s", err)
+			}
+			keys = append(keys, entry.Key)
+		}
+		iterator.Close()
+
+		for _, key := range keys {
+			err = ctx.GetStub().DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// impedisce nuove esecuzioni del modello, mantenendone il record nel world state
+func (sc *SmartContract) RetireModel(ctx CustomTransactionContextInterface, name string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if !model.isActive() {
+		return fmt.Errorf("model %s is already retired", name)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+
+	model.Status = StatusRetired
+	model.RetiredAt = timestamp.GetSeconds()
+	model.PendingOwner = ""
+
+	err = NewModelRepository(ctx).Update(model)
+	if err != nil {
+		return err
+	}
+
+	// la directory può essere condivisa con altri modelli dello stesso archivio,
+	// i file non più usati vengono rimossi da SyncModels su ogni peer
+	models.invalidate(model.Hash)
+	return nil
+}
+
+// elimina dal world state il modello, i suoi indici, le licenze, le statistiche e le recensioni.
+// lo storico resta sul ledger
+func (sc *SmartContract) DeleteModel(ctx CustomTransactionContextInterface, name string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	err = NewModelRepository(ctx).Delete(model)
+	if err != nil {
+		return err
+	}
+
+	err = deleteModelData(ctx, model.Name)
+	if err != nil {
+		return err
+	}
+
+	models.invalidate(model.Hash)
+	return nil
+}
+
+// propone il trasferimento del modello a newOwner, che deve accettarlo con AcceptModelOwnership
+func (sc *SmartContract) TransferModelOwnership(ctx CustomTransactionContextInterface, name string, newOwner string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if !model.isActive() {
+		return fmt.Errorf("model %s is retired", name)
+	}
+
+	if newOwner == model.Creator {
+		return fmt.Errorf("user %s already owns model %s", newOwner, name)
+	}
+
+	user, err := getUserInfo(ctx, newOwner)
+	if err != nil {
+		return err
+	}
+	if user.Role != "dev" {
+		return fmt.Errorf("user %s can't own a model. role: %s", newOwner, user.Role)
+	}
+
+	model.PendingOwner = newOwner
+
+	return NewModelRepository(ctx).Update(model)
+}
+
+func (sc *SmartContract) AcceptModelOwnership(ctx CustomTransactionContextInterface, name string) error {
+	model := ctx.Model()
+
+	userID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return err
+	}
+
+	if model.PendingOwner == "" || model.PendingOwner != userID {
+		return fmt.Errorf("no pending transfer of model %s to %s", name, userID)
+	}
+
+	if !model.isActive() {
+		return fmt.Errorf("model %s is retired", name)
+	}
+
+	log.Printf("model %s transferred from %s to %s", name, model.Creator, userID)
+
+	// il creatore non ha bisogno di autorizzazione, SaveModel lo inserisce in AllowedUsers
+	// e senza rimuoverlo il vecchio proprietario continuerebbe a usare il modello gratis
+	model.removeAllowed(model.Creator)
+	model.Creator = userID
+	model.PendingOwner = ""
+
+	return NewModelRepository(ctx).Update(model)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// dati del world state richiesti da una transazione. ModelArg è l'indice dell'argomento
+// con il nome del modello, NewModel indica che il modello non deve ancora esistere
+type Loads struct {
+	ModelArg int
+	NewModel bool
+}
+
+// dichiarazioni per nome della transazione. le transazioni assenti non leggono nulla
+// prima dell'esecuzione, le altre trovano il modello in ctx.Model()
+var transactionLoads = map[string]Loads{
+	"SaveModel":              {ModelArg: 0, NewModel: true},
+	"GetModel":               {ModelArg: 0},
+	"RunModel":               {ModelArg: 0},
+	"Authorize":              {ModelArg: 0},
+	"GrantLicense":           {ModelArg: 0},
+	"RevokeAccess":           {ModelArg: 0},
+	"ListLicensees":          {ModelArg: 0},
+	"SetAccessPolicy":        {ModelArg: 0},
+	"SetLicensePlan":         {ModelArg: 0},
+	"RemoveLicensePlan":      {ModelArg: 0},
+	"BuyLicense":             {ModelArg: 0},
+	"RetireModel":            {ModelArg: 0},
+	"DeleteModel":            {ModelArg: 0},
+	"TransferModelOwnership": {ModelArg: 0},
+	"AcceptModelOwnership":   {ModelArg: 0},
+	"VerifyModel":            {ModelArg: 0},
+	"SetPostProcessing":      {ModelArg: 0},
+	"SetPreprocessing":       {ModelArg: 0},
+	"UpdateModelMetadata":    {ModelArg: 0},
+	"PinModel":               {ModelArg: 0},
+	"UnpinModel":             {ModelArg: 0},
+	"GetPinStatus":           {ModelArg: 0},
+	"GetModelStats":          {ModelArg: 0},
+	"RateModel":              {ModelArg: 0},
+	"GetModelRating":         {ModelArg: 0},
+	"ListReviews":            {ModelArg: 0},
+}
+
+// eseguita prima di ogni transazione, carica nel contesto i dati dichiarati in transactionLoads
+func LoadEntities(ctx CustomTransactionContextInterface) error {
+	fcn, params := ctx.GetStub().GetFunctionAndParameters()
+	// le transazioni possono essere invocate con il nome del contratto, come SmartContract:RunModel
+	fcn = fcn[strings.LastIndex(fcn, ":")+1:]
+
+	loads, exists := transactionLoads[fcn]
+	if !exists {
+		return nil
+	}
+	if loads.ModelArg >= len(params) {
+		return fmt.Errorf("missing model name argument for %s", fcn)
+	}
+	name := params[loads.ModelArg]
+
+	model, err := NewModelRepository(ctx).Get(name)
+	if err != nil {
+		return err
+	}
+
+	if loads.NewModel {
+		if model != nil {
+			return fmt.Errorf("cannot create world state pair with key %s. Already exists", name)
+		}
+		return nil
+	}
+
+	if model == nil {
+		return fmt.Errorf("no model with key %s found", name)
+	}
+	ctx.SetModel(model)
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// lock su file della directory di un modello, valido tra le transazioni e tra i processi
+// del peer. l'installazione e la rimozione dei file lo prendono in modo esclusivo, la verifica
+// e il caricamento in modo condiviso, così un lettore non vede mai una directory parziale.
+// il file di lock resta accanto alla directory anche dopo la rimozione del modello
+type dirLock struct {
+	file *os.File
+}
+
+func lockModelDir(dir string, exclusive bool) (*dirLock, error) {
+	path := filepath.Clean(dir) + ".lock"
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	for {
+		err = syscall.Flock(int(file.Fd()), how)
+		if err != syscall.EINTR {
+			break
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &dirLock{file: file}, nil
+}
+
+func (l *dirLock) unlock() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	l.file.Close()
+}
+
+// esecuzione singola di fn per chiave: le chiamate concorrenti con la stessa chiave
+// attendono quella in corso e ne ricevono il risultato
+type singleFlight struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done chan struct{}
+	err  error
+}
+
+var fetches = &singleFlight{calls: make(map[string]*flightCall)}
+
+func (s *singleFlight) do(key string, fn func() error) error {
+	s.mu.Lock()
+	if call, exists := s.calls[key]; exists {
+		s.mu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	s.calls[key] = call
+	s.mu.Unlock()
+
+	call.err = fn()
+
+	s.mu.Lock()
+	delete(s.calls, key)
+	s.mu.Unlock()
+	close(call.done)
+	return call.err
+}
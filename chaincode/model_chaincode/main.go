@@ -14,7 +14,7 @@ func main() {
 
 	sc.UnknownTransaction = UnknownTransactionHandler
 
-	sc.BeforeTransaction = GetWorldState
+	sc.BeforeTransaction = LoadEntities
 
 	cc, err := contractapi.NewChaincode(sc)
 
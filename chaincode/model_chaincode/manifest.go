@@ -0,0 +1,300 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"chaincode/modelhash"
+)
+
+// file del modello registrato al salvataggio. il manifest sul ledger non contiene
+// i tempi di modifica, che dipendono dal peer e vengono tenuti in memoria da ogni peer
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	Files []ManifestFile `json:"files"`
+	Root  string         `json:"root"`
+}
+
+// ultima verifica completa dei file di un modello su questo peer
+type verification struct {
+	modTimes   map[string]time.Time
+	verifiedAt time.Time
+}
+
+// verifiche per hash del modello, condivise da tutte le transazioni
+var verifications = struct {
+	sync.Mutex
+	records map[string]*verification
+}{records: make(map[string]*verification)}
+
+// intervallo dopo il quale una verifica rapida viene sostituita da una completa
+var fullVerifyInterval = time.Duration(envInt("MODEL_VERIFY_INTERVAL", 3600)) * time.Second
+
+// calcola il manifest dei file di dir, in ordine lessicografico di percorso
+func buildManifest(dir string) (*Manifest, map[string]time.Time, error) {
+	manifest := new(Manifest)
+	modTimes := make(map[string]time.Time)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		manifest.Files = append(manifest.Files, ManifestFile{Path: rel, Size: info.Size(), SHA256: sum})
+		modTimes[rel] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	manifest.Root = manifest.rootHash()
+	return manifest, modTimes, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// hash della lista dei file, con percorso, dimensione e hash di ognuno
+func (m *Manifest) rootHash() string {
+	h := sha256.New()
+	for _, file := range m.Files {
+		fmt.Fprintf(h, "%s\x00%d\x00%s\n", file.Path, file.Size, file.SHA256)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// confronta i file di dir con il manifest e restituisce le differenze
+func (m *Manifest) verifyFull(dir string) ([]string, map[string]time.Time, error) {
+	current, modTimes, err := buildManifest(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var mismatches []string
+	expected := make(map[string]ManifestFile)
+	for _, file := range m.Files {
+		expected[file.Path] = file
+	}
+	for _, file := range current.Files {
+		e, exists := expected[file.Path]
+		if !exists {
+			mismatches = append(mismatches, fmt.Sprintf("unexpected file %s", file.Path))
+			continue
+		}
+		if e.Size != file.Size || e.SHA256 != file.SHA256 {
+			mismatches = append(mismatches, fmt.Sprintf("file %s modified", file.Path))
+		}
+		delete(expected, file.Path)
+	}
+	for _, file := range m.Files {
+		if _, missing := expected[file.Path]; missing {
+			mismatches = append(mismatches, fmt.Sprintf("missing file %s", file.Path))
+		}
+	}
+	if m.rootHash() != m.Root {
+		mismatches = append(mismatches, "manifest root hash doesn't match its files")
+	}
+	return mismatches, modTimes, nil
+}
+
+// verifica rapida: numero, dimensione e tempo di modifica dei file rispetto all'ultima verifica completa
+func (m *Manifest) verifyQuick(dir string, record *verification) bool {
+	count := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			count++
+		}
+		return nil
+	})
+	if err != nil || count != len(m.Files) {
+		return false
+	}
+
+	for _, file := range m.Files {
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(file.Path)))
+		if err != nil || info.Size() != file.Size || !info.ModTime().Equal(record.modTimes[file.Path]) {
+			return false
+		}
+	}
+	return true
+}
+
+func recordVerification(hash string, modTimes map[string]time.Time) {
+	verifications.Lock()
+	defer verifications.Unlock()
+	verifications.records[hash] = &verification{modTimes: modTimes, verifiedAt: time.Now()}
+}
+
+// confronto con l'hash dell'intera directory secondo lo schema del modello
+func checkHash(model *Model) error {
+	lock, err := lockModelDir(model.Location, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	return checkHashDir(model, model.Location)
+}
+
+func checkHashDir(model *Model, dir string) error {
+	var hashString string
+
+	switch model.HashScheme {
+	case 0:
+		h := sha256.New()
+		err := hashDir(dir, h)
+		if err != nil {
+			return err
+		}
+		hashString = fmt.Sprintf("%x", h.Sum(nil))
+	case modelhash.Version:
+		var err error
+		hashString, err = modelhash.HashDir(dir)
+		if err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown hash scheme %d", model.HashScheme)
+	}
+
+	if hashString != model.Hash {
+		return fmt.Errorf("hash doesn't match")
+	}
+	return nil
+}
+
+// verifica l'integrità dei file del modello prima dell'esecuzione. se i file non sono cambiati
+// dall'ultima verifica completa e questa è abbastanza recente non vengono riletti
+func checkIntegrity(model *Model) error {
+	if model.Manifest == nil {
+		return checkHash(model)
+	}
+
+	lock, err := lockModelDir(model.Location, false)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	verifications.Lock()
+	record := verifications.records[model.Hash]
+	verifications.Unlock()
+
+	if record != nil && time.Since(record.verifiedAt) < fullVerifyInterval && model.Manifest.verifyQuick(model.Location, record) {
+		return nil
+	}
+
+	mismatches, modTimes, err := model.Manifest.verifyFull(model.Location)
+	if err != nil {
+		return err
+	}
+	if len(mismatches) > 0 {
+		verifications.Lock()
+		delete(verifications.records, model.Hash)
+		verifications.Unlock()
+		return fmt.Errorf("model files don't match the manifest: %v", mismatches)
+	}
+
+	// il manifest elenca solo i file: file in più, permessi, directory e link simbolici
+	// sono coperti dall'hash del modello
+	err = checkHashDir(model, model.Location)
+	if err != nil {
+		verifications.Lock()
+		delete(verifications.records, model.Hash)
+		verifications.Unlock()
+		return err
+	}
+
+	recordVerification(model.Hash, modTimes)
+	return nil
+}
+
+type VerifyResult struct {
+	Model      string   `json:"model"`
+	Valid      bool     `json:"valid"`
+	Mismatches []string `json:"mismatches"`
+}
+
+// verifica completa dei file del modello su questo peer
+func (sc *SmartContract) VerifyModel(ctx CustomTransactionContextInterface, name string) (*VerifyResult, error) {
+	model := ctx.Model()
+
+	result := VerifyResult{Model: name, Valid: true, Mismatches: []string{}}
+
+	if model.Manifest == nil {
+		err := checkHash(model)
+		if err != nil {
+			result.Valid = false
+			result.Mismatches = []string{err.Error()}
+		}
+		return &result, nil
+	}
+
+	lock, err := lockModelDir(model.Location, false)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.unlock()
+
+	mismatches, modTimes, err := model.Manifest.verifyFull(model.Location)
+	if err != nil {
+		return nil, err
+	}
+	if len(mismatches) > 0 {
+		result.Valid = false
+		result.Mismatches = mismatches
+		return &result, nil
+	}
+
+	err = checkHashDir(model, model.Location)
+	if err != nil {
+		result.Valid = false
+		result.Mismatches = []string{err.Error()}
+		return &result, nil
+	}
+
+	recordVerification(model.Hash, modTimes)
+	return &result, nil
+}
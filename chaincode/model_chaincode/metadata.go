@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// limiti dei metadati, perché il record del modello resti di dimensioni contenute
+const (
+	maxDescriptionLength = 4096
+	maxFieldLength       = 256
+	maxTags              = 20
+	maxTagLength         = 64
+	maxMetrics           = 32
+)
+
+// descrizione del modello per il catalogo. Task è il tipo di problema (ad esempio
+// image-classification), License la licenza d'uso, Dataset un riferimento ai dati di
+// addestramento e Metrics le metriche dichiarate dal creatore, come accuracy o f1
+type ModelMetadata struct {
+	Description      string             `json:"description"`
+	Task             string             `json:"task"`
+	License          string             `json:"license"`
+	Framework        string             `json:"framework"`
+	FrameworkVersion string             `json:"framework_version"`
+	Dataset          string             `json:"dataset"`
+	Metrics          map[string]float64 `json:"metrics,omitempty" metadata:",optional"`
+}
+
+// aggiornamento parziale: i campi assenti restano invariati, una metrica null viene rimossa
+type metadataUpdate struct {
+	*ModelMetadata
+	Metrics map[string]*float64 `json:"metrics"`
+	Tags    *[]string           `json:"tags"`
+}
+
+func (md *ModelMetadata) validate() error {
+	if len(md.Description) > maxDescriptionLength {
+		return fmt.Errorf("description longer than %d characters", maxDescriptionLength)
+	}
+	fields := map[string]string{
+		"task":              md.Task,
+		"license":           md.License,
+		"framework":         md.Framework,
+		"framework_version": md.FrameworkVersion,
+		"dataset":           md.Dataset,
+	}
+	for name, value := range fields {
+		if len(value) > maxFieldLength {
+			return fmt.Errorf("%s longer than %d characters", name, maxFieldLength)
+		}
+	}
+	if len(md.Metrics) > maxMetrics {
+		return fmt.Errorf("%d metrics, the limit is %d", len(md.Metrics), maxMetrics)
+	}
+	for name, value := range md.Metrics {
+		if name == "" || len(name) > maxTagLength {
+			return fmt.Errorf("invalid metric name %q", name)
+		}
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return fmt.Errorf("invalid value for metric %s", name)
+		}
+	}
+	return nil
+}
+
+// normalizza i tag in minuscolo, senza spazi e senza duplicati
+func normalizeTags(tags []string) ([]string, error) {
+	if len(tags) > maxTags {
+		return nil, fmt.Errorf("%d tags, the limit is %d", len(tags), maxTags)
+	}
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxTagLength {
+			return nil, fmt.Errorf("invalid tag %q", tag)
+		}
+		if !containsString(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	return normalized, nil
+}
+
+// aggiorna i metadati e i tag del modello con i campi presenti in metadata, un documento JSON
+// con i campi di ModelMetadata e tags. i tag sostituiscono quelli precedenti
+func (sc *SmartContract) UpdateModelMetadata(ctx CustomTransactionContextInterface, name string, metadata string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	current := ModelMetadata{}
+	if model.Metadata != nil {
+		current = *model.Metadata
+	}
+	metrics := current.Metrics
+	current.Metrics = nil
+
+	update := metadataUpdate{ModelMetadata: &current}
+	err = json.Unmarshal([]byte(metadata), &update)
+	if err != nil {
+		return fmt.Errorf("error parsing metadata: %s", err)
+	}
+
+	if update.Metrics != nil {
+		merged := make(map[string]float64)
+		for key, value := range metrics {
+			merged[key] = value
+		}
+		for key, value := range update.Metrics {
+			if value == nil {
+				delete(merged, key)
+			} else {
+				merged[key] = *value
+			}
+		}
+		metrics = merged
+	}
+	if len(metrics) > 0 {
+		current.Metrics = metrics
+	}
+
+	err = current.validate()
+	if err != nil {
+		return fmt.Errorf("invalid metadata: %s", err)
+	}
+	model.Metadata = &current
+
+	if update.Tags != nil {
+		model.Tags, err = normalizeTags(*update.Tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return NewModelRepository(ctx).Update(model)
+}
@@ -2,26 +2,62 @@ package main
 
 import (
 	"bytes"
-	"errors"
+	"encoding/json"
+	"fmt"
 
 	tf "github.com/galeone/tensorflow/tensorflow/go"
-	tg "github.com/galeone/tfgo"
 )
 
 const MODELS_FOLDER = "./models/"
 
+const (
+	StatusActive  = "active"
+	StatusRetired = "retired"
+)
+
+// politiche di accesso: chiunque, tramite acquisto di una licenza o su approvazione del creatore
+const (
+	AccessOpen     = "open"
+	AccessPaid     = "paid"
+	AccessApproval = "approval"
+)
+
 type Model struct {
-	Id           string   `json:"id"`
-	Name         string   `json:"name"`
-	Hash         string   `json:"hash"`
-	Location     string   `json:"location"`
-	Input        Data     `json:"input"`
-	Output       Data     `json:"output"`
-	Creator      string   `json:"creator"`
-	AllowedUsers []string `json:"allowed_users"`
+	Id           string    `json:"id"`
+	Name         string    `json:"name"`
+	Hash         string    `json:"hash"`
+	HashScheme   int       `json:"hash_scheme"` // 0 per i modelli con l'hash dei soli contenuti
+	Manifest     *Manifest `json:"manifest,omitempty"`
+	Location     string    `json:"location"`
+	Source       string    `json:"source,omitempty"` // posizione dell'archivio nel ModelStore
+	Pinned       bool      `json:"pinned,omitempty"` // archivio fissato sul nodo ipfs
+	Inputs       []Data    `json:"inputs"`
+	Outputs      []Data    `json:"outputs"`
+	Creator      string    `json:"creator"`
+	AllowedUsers []string  `json:"allowed_users"`
+	Status       string    `json:"status"`
+	RetiredAt    int64     `json:"retired_at,omitempty"`
+	PendingOwner string    `json:"pending_owner,omitempty"`
+	AccessPolicy string    `json:"access_policy"`
+	Tags         []string  `json:"tags,omitempty"`
+	// descrizione e caratteristiche del modello, modificabili con UpdateModelMetadata
+	Metadata *ModelMetadata `json:"metadata,omitempty"`
+	// piani di licenza acquistabili con BuyLicense, per nome
+	Plans map[string]LicensePlan `json:"plans,omitempty"`
+	// post-elaborazione applicata su richiesta da RunModel
+	PostProcess *PostProcess `json:"postprocess,omitempty"`
+	// conversione degli input da immagini o JSON, per chiave dell'input
+	Preprocess map[string]*Preprocess `json:"preprocess,omitempty"`
+
+	// singolo input e output dei modelli salvati prima delle firme con più tensori
+	Input  *Data `json:"input,omitempty"`
+	Output *Data `json:"output,omitempty"`
 }
 
+// tensore della firma del modello. Key è il nome con cui il client lo passa o lo riceve,
+// Name e Idx identificano l'operazione nel grafo
 type Data struct {
+	Key      string      `json:"key"`
 	Name     string      `json:"name"`
 	DataType tf.DataType `json:"datatype"`
 	Shape    []int64     `json:"shape"`
@@ -48,41 +84,157 @@ var tfTypes = map[string]tf.DataType{
 }
 
 type ModelResult struct {
-	Name   string `json:"name"`
-	Input  Data   `json:"input"`
-	Output Data   `json:"output"`
+	Name         string                 `json:"name"`
+	Hash         string                 `json:"hash"`
+	HashScheme   int                    `json:"hash_scheme"`
+	Source       string                 `json:"source,omitempty"`
+	Pinned       bool                   `json:"pinned,omitempty" metadata:",optional"`
+	Inputs       []Data                 `json:"inputs"`
+	Outputs      []Data                 `json:"outputs"`
+	Status       string                 `json:"status"`
+	AccessPolicy string                 `json:"access_policy"`
+	Tags         []string               `json:"tags,omitempty" metadata:",optional"`
+	Metadata     *ModelMetadata         `json:"metadata,omitempty" metadata:",optional"`
+	Rating       *Rating                `json:"rating,omitempty" metadata:",optional"` // solo in GetModel e nel catalogo
+	Plans        map[string]LicensePlan `json:"plans,omitempty" metadata:",optional"`
+	PostProcess  *PostProcess           `json:"postprocess,omitempty" metadata:",optional"`
+	Preprocess   map[string]*Preprocess `json:"preprocess,omitempty" metadata:",optional"`
+}
+
+func (m *Model) result() *ModelResult {
+	return &ModelResult{
+		Name:         m.Name,
+		Hash:         m.Hash,
+		HashScheme:   m.HashScheme,
+		Source:       m.source(),
+		Pinned:       m.Pinned,
+		Inputs:       m.Inputs,
+		Outputs:      m.Outputs,
+		Status:       m.Status,
+		AccessPolicy: m.accessPolicy(),
+		Tags:         m.Tags,
+		Metadata:     m.Metadata,
+		Plans:        m.Plans,
+		PostProcess:  m.PostProcess,
+		Preprocess:   m.Preprocess,
+	}
 }
 
-func (m *Model) execute(input []byte) (*tf.Tensor, error) {
+// legge un modello dal world state, convertendo input e output singoli in firme
+func modelFromBytes(modelBytes []byte) (*Model, error) {
+	model := new(Model)
+	err := json.Unmarshal(modelBytes, model)
+	if err != nil {
+		return nil, err
+	}
 
-	model := tg.LoadModel(m.Location, []string{"serve"}, nil)
+	if len(model.Inputs) == 0 && model.Input != nil {
+		model.Input.Key = model.Input.Name
+		model.Inputs = []Data{*model.Input}
+	}
+	if len(model.Outputs) == 0 && model.Output != nil {
+		model.Output.Key = model.Output.Name
+		model.Outputs = []Data{*model.Output}
+	}
+	model.Input = nil
+	model.Output = nil
 
-	inputTensor, err := tf.ReadTensor(m.Input.DataType, m.Input.Shape, bytes.NewReader(input))
+	return model, nil
+}
 
-	if err != nil {
-		return nil, errors.New("error creating input tensor")
+func (m *Model) input(key string) (*Data, error) {
+	for i := range m.Inputs {
+		if m.Inputs[i].Key == key {
+			return &m.Inputs[i], nil
+		}
 	}
+	return nil, fmt.Errorf("model %s has no input %s", m.Name, key)
+}
 
-	results := model.Exec([]tf.Output{
-		model.Op(m.Output.Name, m.Output.Idx),
-	}, map[tf.Output]*tf.Tensor{
-		model.Op(m.Input.Name, m.Input.Idx): inputTensor,
-	})
+// restituisce gli output della firma con le chiavi richieste, tutti se keys è vuoto
+func (m *Model) selectOutputs(keys []string) ([]Data, error) {
+	if len(keys) == 0 {
+		return m.Outputs, nil
+	}
 
-	return results[0], nil
+	var outputs []Data
+	for _, key := range keys {
+		found := false
+		for _, output := range m.Outputs {
+			if output.Key == key {
+				outputs = append(outputs, output)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("model %s has no output %s", m.Name, key)
+		}
+	}
+	return outputs, nil
 }
 
-func (m *Model) authorize(userID string) error {
+// esegue il modello con gli input indicati per chiave, restituendo i tensori di outputs per chiave.
+// batch è il numero di elementi concatenati in ogni input
+func (m *Model) execute(inputs map[string][]byte, outputs []Data, batch int) (map[string]*tf.Tensor, error) {
 
-	for _, id := range m.AllowedUsers {
-		if id == userID {
-			return errors.New("user already authorized")
+	if len(inputs) != len(m.Inputs) {
+		return nil, fmt.Errorf("model %s expects %d inputs, got %d", m.Name, len(m.Inputs), len(inputs))
+	}
+
+	for _, in := range m.Inputs {
+		input, exists := inputs[in.Key]
+		if !exists {
+			return nil, fmt.Errorf("missing input %s", in.Key)
+		}
+		err := validateInput(in, input, batch)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	loaded, err := models.acquire(m.Hash, m.Location)
+	if err != nil {
+		return nil, err
+	}
+	defer models.release(loaded)
+
+	feeds := make(map[tf.Output]*tf.Tensor)
+
+	for _, in := range m.Inputs {
+		inputTensor, err := tf.ReadTensor(in.DataType, in.batchShape(batch), bytes.NewReader(inputs[in.Key]))
+		if err != nil {
+			return nil, fmt.Errorf("error creating input tensor %s: %s", in.Key, err)
+		}
+		op, err := loaded.op(in.Name, in.Idx)
+		if err != nil {
+			return nil, err
+		}
+		feeds[op] = inputTensor
+	}
+
+	var fetches []tf.Output
+	for _, out := range outputs {
+		op, err := loaded.op(out.Name, out.Idx)
+		if err != nil {
+			return nil, err
 		}
+		fetches = append(fetches, op)
+	}
+
+	results, err := loaded.saved.Session.Run(feeds, fetches, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error running model: %s", err)
 	}
-	m.AllowedUsers = append(m.AllowedUsers, userID)
-	return nil
+
+	tensors := make(map[string]*tf.Tensor)
+	for i, out := range outputs {
+		tensors[out.Key] = results[i]
+	}
+	return tensors, nil
 }
 
+// appartenenza alla lista AllowedUsers, usata solo per le autorizzazioni precedenti alle licenze
 func (m *Model) isAllowed(userID string) bool {
 	for _, id := range m.AllowedUsers {
 		if userID == id {
@@ -91,3 +243,57 @@ func (m *Model) isAllowed(userID string) bool {
 	}
 	return false
 }
+
+// i modelli salvati prima dei ModelStore vengono da ipfs, con il CID come Id
+func (m *Model) source() string {
+	if m.Source == "" {
+		return "ipfs://" + m.Id
+	}
+	return m.Source
+}
+
+// i modelli salvati prima dell'introduzione dello stato non hanno Status
+func (m *Model) isActive() bool {
+	return m.Status == "" || m.Status == StatusActive
+}
+
+func (m *Model) status() string {
+	if m.Status == "" {
+		return StatusActive
+	}
+	return m.Status
+}
+
+func (m *Model) removeAllowed(userID string) {
+	for i, id := range m.AllowedUsers {
+		if id == userID {
+			m.AllowedUsers = append(m.AllowedUsers[:i], m.AllowedUsers[i+1:]...)
+			return
+		}
+	}
+}
+
+// i modelli salvati prima delle politiche di accesso richiedono l'approvazione del creatore
+func (m *Model) accessPolicy() string {
+	if m.AccessPolicy == "" {
+		return AccessApproval
+	}
+	return m.AccessPolicy
+}
+
+// la prima dimensione del tensore è quella del batch se vale -1, come nelle firme, oppure 1
+// con più elementi, e viene sostituita dal numero di elementi dell'esecuzione.
+// una prima dimensione fissa diversa fa parte della forma dell'input e resta invariata
+func (d Data) batchShape(batch int) []int64 {
+	shape := make([]int64, len(d.Shape))
+	copy(shape, d.Shape)
+	if len(shape) > 0 && (shape[0] == -1 || shape[0] == 1 && batch > 1) {
+		shape[0] = int64(batch)
+	}
+	return shape
+}
+
+// il tensore ha una dimensione del batch in cui accodare gli elementi dell'esecuzione
+func (d Data) batchable() bool {
+	return len(d.Shape) > 0 && (d.Shape[0] == -1 || d.Shape[0] == 1)
+}
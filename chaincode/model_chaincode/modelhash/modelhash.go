@@ -0,0 +1,218 @@
+// Package modelhash calcola l'hash canonico di un modello, come albero di Merkle
+// su percorsi, permessi e contenuti dei file. La stessa funzione viene usata dal
+// chaincode sui file estratti e può essere usata dai client sull'archivio prima del caricamento.
+package modelhash
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// versione dello schema di hash registrata su ogni modello
+const Version = 1
+
+// nodo dell'albero: file, link simbolico o directory
+type node struct {
+	kind       string
+	executable bool
+	digest     string
+	target     string
+	children   map[string]*node
+}
+
+func newDir() *node {
+	return &node{kind: "dir", children: make(map[string]*node)}
+}
+
+// i permessi vengono ridotti al bit di esecuzione del proprietario, come in git,
+// per non dipendere dalla umask del peer che estrae l'archivio
+func mode(executable bool) string {
+	if executable {
+		return "755"
+	}
+	return "644"
+}
+
+func (n *node) hash() string {
+	h := sha256.New()
+	switch n.kind {
+	case "file":
+		fmt.Fprintf(h, "file\x00%s\x00%s", mode(n.executable), n.digest)
+	case "symlink":
+		fmt.Fprintf(h, "symlink\x00%s", n.target)
+	case "dir":
+		var names []string
+		for name := range n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprint(h, "dir\x00")
+		for _, name := range names {
+			fmt.Fprintf(h, "%s\x00%s\n", name, n.children[name].hash())
+		}
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// inserisce un nodo nel percorso p, creando le directory intermedie
+func (n *node) insert(p string, child *node) error {
+	parts := strings.Split(p, "/")
+	dir := n
+	for _, part := range parts[:len(parts)-1] {
+		next, exists := dir.children[part]
+		if !exists {
+			next = newDir()
+			dir.children[part] = next
+		}
+		if next.kind != "dir" {
+			return fmt.Errorf("%s is not a directory", part)
+		}
+		dir = next
+	}
+
+	name := parts[len(parts)-1]
+	if existing, exists := dir.children[name]; exists && existing.kind == "dir" && child.kind == "dir" {
+		return nil
+	}
+	dir.children[name] = child
+	return nil
+}
+
+func lookup(root *node, p string) *node {
+	n := root
+	for _, part := range strings.Split(p, "/") {
+		if n == nil || n.kind != "dir" {
+			return nil
+		}
+		n = n.children[part]
+	}
+	return n
+}
+
+func digest(r io.Reader) (string, error) {
+	h := sha256.New()
+	_, err := io.Copy(h, r)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// HashDir calcola l'hash del modello estratto in dir
+func HashDir(dir string) (string, error) {
+	root := newDir()
+
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+
+		switch {
+		case info.IsDir():
+			return root.insert(rel, newDir())
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return root.insert(rel, &node{kind: "symlink", target: filepath.ToSlash(target)})
+		case info.Mode().IsRegular():
+			file, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			sum, err := digest(file)
+			if err != nil {
+				return err
+			}
+			return root.insert(rel, &node{kind: "file", executable: info.Mode()&0100 != 0, digest: sum})
+		}
+		return fmt.Errorf("unsupported file type %s", rel)
+	})
+	if err != nil {
+		return "", err
+	}
+	return root.hash(), nil
+}
+
+// HashArchive calcola l'hash del modello contenuto in un archivio tar.gz,
+// uguale a quello di HashDir sulla directory in cui l'archivio viene estratto
+func HashArchive(r io.Reader) (string, error) {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	tarReader := tar.NewReader(gzr)
+	root := newDir()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		name := path.Clean(strings.TrimPrefix(header.Name, "./"))
+		if name == "." || name == "/" {
+			continue
+		}
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return "", fmt.Errorf("invalid path %s in archive", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = root.insert(name, newDir())
+		case tar.TypeSymlink:
+			err = root.insert(name, &node{kind: "symlink", target: header.Linkname})
+		case tar.TypeLink:
+			target := lookup(root, path.Clean(strings.TrimPrefix(header.Linkname, "./")))
+			if target == nil || target.kind != "file" {
+				return "", fmt.Errorf("hard link %s to unknown file %s", header.Name, header.Linkname)
+			}
+			linked := *target
+			err = root.insert(name, &linked)
+		case tar.TypeReg:
+			var sum string
+			sum, err = digest(tarReader)
+			if err == nil {
+				err = root.insert(name, &node{kind: "file", executable: header.Mode&0100 != 0, digest: sum})
+			}
+		default:
+			// gli altri tipi di voce non vengono estratti
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return root.hash(), nil
+}
+
+// HashFile calcola l'hash dell'archivio tar.gz in path
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return HashArchive(file)
+}
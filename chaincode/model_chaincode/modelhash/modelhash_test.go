@@ -0,0 +1,226 @@
+package modelhash
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// voce di un albero di prova, scritta sia nell'archivio sia sul disco
+type entry struct {
+	name   string
+	kind   byte
+	body   string
+	mode   int64
+	target string
+}
+
+func file(name string, body string) entry {
+	return entry{name: name, kind: tar.TypeReg, body: body, mode: 0644}
+}
+
+func executable(name string, body string) entry {
+	return entry{name: name, kind: tar.TypeReg, body: body, mode: 0755}
+}
+
+func dir(name string) entry {
+	return entry{name: name, kind: tar.TypeDir, mode: 0755}
+}
+
+func symlink(name string, target string) entry {
+	return entry{name: name, kind: tar.TypeSymlink, target: target}
+}
+
+func hardlink(name string, target string) entry {
+	return entry{name: name, kind: tar.TypeLink, target: target}
+}
+
+func archive(t *testing.T, entries []entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gzw)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Typeflag: e.kind, Mode: e.mode, Linkname: e.target}
+		if e.kind == tar.TypeReg {
+			header.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if e.kind == tar.TypeReg {
+			if _, err := tw.Write([]byte(e.body)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// scrive l'albero sul disco come farebbe l'estrazione dell'archivio
+func writeTree(t *testing.T, entries []entry) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, e := range entries {
+		p := filepath.Join(root, filepath.FromSlash(e.name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		var err error
+		switch e.kind {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, 0755)
+		case tar.TypeReg:
+			err = os.WriteFile(p, []byte(e.body), os.FileMode(e.mode))
+			if err == nil {
+				err = os.Chmod(p, os.FileMode(e.mode))
+			}
+		case tar.TypeSymlink:
+			err = os.Symlink(e.target, p)
+		case tar.TypeLink:
+			err = os.Link(filepath.Join(root, filepath.FromSlash(e.target)), p)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+var trees = []struct {
+	name    string
+	entries []entry
+}{
+	{"empty", nil},
+	{"single file", []entry{file("saved_model.pb", "graph")}},
+	{"empty file", []entry{file("empty", "")}},
+	{"nested files", []entry{
+		dir("variables/"),
+		file("saved_model.pb", "graph"),
+		file("variables/variables.index", "index"),
+		file("variables/variables.data-00000-of-00001", "data"),
+	}},
+	{"implicit parent directories", []entry{file("a/b/c/deep.txt", "deep")}},
+	{"empty directories", []entry{dir("assets/"), dir("variables/"), dir("variables/empty/"), file("saved_model.pb", "graph")}},
+	{"executable file", []entry{executable("run.sh", "#!/bin/sh"), file("saved_model.pb", "graph")}},
+	{"symlinks", []entry{
+		file("saved_model.pb", "graph"),
+		dir("assets/"),
+		symlink("model.pb", "saved_model.pb"),
+		symlink("assets/link", "../saved_model.pb"),
+	}},
+	{"hardlink", []entry{file("saved_model.pb", "graph"), hardlink("copy.pb", "saved_model.pb")}},
+	{"dot prefixed names", []entry{{name: "./saved_model.pb", kind: tar.TypeReg, body: "graph", mode: 0644}}},
+}
+
+func TestHashDirMatchesHashArchive(t *testing.T) {
+	for _, tree := range trees {
+		t.Run(tree.name, func(t *testing.T) {
+			fromArchive, err := HashArchive(bytes.NewReader(archive(t, tree.entries)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			fromDir, err := HashDir(writeTree(t, tree.entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fromArchive != fromDir {
+				t.Fatalf("HashArchive %s, HashDir %s", fromArchive, fromDir)
+			}
+		})
+	}
+}
+
+// ogni modifica dell'albero deve cambiare l'hash
+func TestHashDetectsChanges(t *testing.T) {
+	base := []entry{dir("variables/"), file("saved_model.pb", "graph"), file("variables/data", "data")}
+	changes := []struct {
+		name    string
+		entries []entry
+	}{
+		{"content", []entry{dir("variables/"), file("saved_model.pb", "graph!"), file("variables/data", "data")}},
+		{"extra file", append(append([]entry{}, base...), file("extra", ""))},
+		{"extra empty directory", append(append([]entry{}, base...), dir("extra/"))},
+		{"renamed file", []entry{dir("variables/"), file("model.pb", "graph"), file("variables/data", "data")}},
+		{"moved file", []entry{dir("variables/"), file("saved_model.pb", "graph"), file("data", "data")}},
+		{"executable bit", []entry{dir("variables/"), executable("saved_model.pb", "graph"), file("variables/data", "data")}},
+		{"file replaced by symlink", []entry{dir("variables/"), file("saved_model.pb", "graph"), symlink("variables/data", "../saved_model.pb")}},
+	}
+
+	baseHash, err := HashDir(writeTree(t, base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, change := range changes {
+		t.Run(change.name, func(t *testing.T) {
+			h, err := HashDir(writeTree(t, change.entries))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h == baseHash {
+				t.Fatal("hash unchanged")
+			}
+		})
+	}
+
+	// il symlink con un altro target
+	a, _ := HashDir(writeTree(t, []entry{file("x", ""), file("y", ""), symlink("l", "x")}))
+	b, _ := HashDir(writeTree(t, []entry{file("x", ""), file("y", ""), symlink("l", "y")}))
+	if a == b {
+		t.Fatal("symlink target change not detected")
+	}
+
+	// solo il bit di esecuzione del proprietario fa parte dell'hash
+	c, _ := HashDir(writeTree(t, []entry{{name: "f", kind: tar.TypeReg, body: "x", mode: 0600}}))
+	d, _ := HashDir(writeTree(t, []entry{{name: "f", kind: tar.TypeReg, body: "x", mode: 0644}}))
+	if c != d {
+		t.Fatal("permissions other than the owner execute bit changed the hash")
+	}
+}
+
+// valori di riferimento della versione 1. l'hash è registrato sui modelli salvati e confrontato
+// da tutti i peer: se uno di questi test fallisce lo schema va incrementato, non aggiornato
+func TestVersion1Golden(t *testing.T) {
+	if Version != 1 {
+		t.Fatalf("Version is %d, add golden values for the new scheme", Version)
+	}
+
+	golden := []struct {
+		name    string
+		entries []entry
+		hash    string
+	}{
+		// sha256("dir\x00")
+		{"empty", nil, "34312174686ce443db57c7fda1233d8a4615dd0ac30168116fcf35fee068e0ba"},
+		{"single file", []entry{file("saved_model.pb", "graph")}, "92487d3ca6f8f5bc2842934d9edbabbe143c275ca01562e06a6d71dbd8ee3534"},
+		{"model", []entry{
+			dir("assets/"),
+			dir("variables/"),
+			file("saved_model.pb", "graph"),
+			executable("variables/run.sh", "#!/bin/sh"),
+			file("variables/variables.index", "index"),
+			symlink("model.pb", "saved_model.pb"),
+		}, "89434199ac8bbab3a523a233758c59bdbb9bc607de28de06be908b7ddf44b451"},
+	}
+
+	for _, g := range golden {
+		t.Run(g.name, func(t *testing.T) {
+			h, err := HashArchive(bytes.NewReader(archive(t, g.entries)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h != g.hash {
+				t.Fatalf("hash %s, expected %s", h, g.hash)
+			}
+		})
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+// tensore restituito da RunModel. Values contiene i valori come array JSON annidato
+// secondo Shape, oppure piatto se richiesto; Raw i byte del tensore in base64
+type TensorResult struct {
+	Name   string      `json:"name"`
+	DType  string      `json:"dtype"`
+	Shape  []int64     `json:"shape"`
+	Values interface{} `json:"values,omitempty"`
+	Raw    string      `json:"raw,omitempty"`
+}
+
+type RunResult struct {
+	Outputs []TensorResult `json:"outputs"`
+	Batch   int            `json:"batch"`
+	// risultato della post-elaborazione, una lista per elemento del batch
+	Predictions [][]Prediction `json:"predictions,omitempty"`
+}
+
+// formato del risultato, letto dal transient map con la chiave "format".
+// Labels richiede la post-elaborazione impostata dal creatore del modello
+type OutputFormat struct {
+	Flat   bool `json:"flat"`
+	Raw    bool `json:"raw"`
+	Labels bool `json:"labels"`
+}
+
+func readOutputFormat(transientMap map[string][]byte) (*OutputFormat, error) {
+	format := new(OutputFormat)
+	if f, exists := transientMap["format"]; exists {
+		err := json.Unmarshal(f, format)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing output format: %s", err)
+		}
+	}
+	return format, nil
+}
+
+func dataTypeName(dt tf.DataType) string {
+	for name, t := range tfTypes {
+		// complex è un alias di complex64
+		if t == dt && name != "complex" {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", dt)
+}
+
+// i tipi complessi, half e bfloat16 non hanno una rappresentazione JSON e vengono restituiti solo come byte
+func hasJSONValues(dt tf.DataType) bool {
+	switch dt {
+	case tf.Complex64, tf.Complex128, tf.Half, tf.Bfloat16:
+		return false
+	}
+	return true
+}
+
+func tensorResult(key string, tensor *tf.Tensor, format *OutputFormat) (*TensorResult, error) {
+	result := TensorResult{
+		Name:  key,
+		DType: dataTypeName(tensor.DataType()),
+		Shape: tensor.Shape(),
+	}
+
+	jsonValues := hasJSONValues(tensor.DataType())
+
+	if jsonValues {
+		values := tensor.Value()
+		if format.Flat {
+			values = flatten(values)
+		} else if tensor.DataType() == tf.Uint8 {
+			values = uint8Values(reflect.ValueOf(values))
+		}
+		result.Values = values
+	}
+
+	if format.Raw || !jsonValues {
+		var buf bytes.Buffer
+		_, err := tensor.WriteContentsTo(&buf)
+		if err != nil {
+			return nil, fmt.Errorf("error reading output %s: %s", key, err)
+		}
+		result.Raw = base64.StdEncoding.EncodeToString(buf.Bytes())
+	}
+	return &result, nil
+}
+
+// encoding/json codifica []uint8 come stringa base64, gli ultimi livelli diventano []int
+func uint8Values(v reflect.Value) interface{} {
+	if v.Kind() != reflect.Slice {
+		return v.Interface()
+	}
+	if v.Type().Elem().Kind() == reflect.Uint8 {
+		ints := make([]int, v.Len())
+		for i := range ints {
+			ints[i] = int(v.Index(i).Uint())
+		}
+		return ints
+	}
+	values := make([]interface{}, v.Len())
+	for i := range values {
+		values[i] = uint8Values(v.Index(i))
+	}
+	return values
+}
+
+// appiattisce slice annidate in una slice di un solo livello
+func flatten(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		return []interface{}{value}
+	}
+
+	var flat []interface{}
+	var walk func(v reflect.Value)
+	walk = func(v reflect.Value) {
+		if v.Kind() != reflect.Slice {
+			flat = append(flat, v.Interface())
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			walk(v.Index(i))
+		}
+	}
+	walk(v)
+	return flat
+}
+
+// costruisce il risultato JSON di RunModel, con gli output nell'ordine della firma
+func runResult(model *Model, predictions map[string]*tf.Tensor, outputs []Data, batch int, format *OutputFormat) (string, error) {
+	result := RunResult{Batch: batch}
+
+	if format.Labels {
+		key := model.PostProcess.outputKey(model)
+		tensor, exists := predictions[key]
+		if !exists {
+			return "", fmt.Errorf("output %s needed for post-processing was not requested", key)
+		}
+		labeled, err := model.PostProcess.apply(model, tensor.Value(), tensor.Shape())
+		if err != nil {
+			return "", fmt.Errorf("error post-processing output %s: %s", key, err)
+		}
+		result.Predictions = labeled
+	}
+
+	for _, output := range outputs {
+		tensor, exists := predictions[output.Key]
+		if !exists {
+			return "", fmt.Errorf("missing output %s", output.Key)
+		}
+		t, err := tensorResult(output.Key, tensor, format)
+		if err != nil {
+			return "", err
+		}
+		result.Outputs = append(result.Outputs, *t)
+	}
+
+	resultJSON, err := json.Marshal(result)
+	if err != nil {
+		return "", fmt.Errorf("error marshaling result, non finite values can be read with the raw format: %s", err)
+	}
+	return string(resultJSON), nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// i valori uint8 annidati restano array di numeri e non stringhe base64
+func TestUint8Values(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{uint8(7), `7`},
+		{[]uint8{1, 2, 255}, `[1,2,255]`},
+		{[][]uint8{{1, 2}, {3, 4}}, `[[1,2],[3,4]]`},
+		{[][][]uint8{{{0}}, {{9}}}, `[[[0]],[[9]]]`},
+		{[][]uint8{}, `[]`},
+	}
+	for _, test := range tests {
+		encoded, err := json.Marshal(uint8Values(reflect.ValueOf(test.value)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(encoded) != test.expected {
+			t.Fatalf("%v encoded as %s, expected %s", test.value, encoded, test.expected)
+		}
+	}
+}
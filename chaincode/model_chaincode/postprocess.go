@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// post-elaborazione dell'output di un classificatore. Labels è il percorso, relativo
+// alla directory del modello, di un file con un'etichetta per riga
+type PostProcess struct {
+	Output    string  `json:"output"`
+	Softmax   bool    `json:"softmax"`
+	TopK      int     `json:"top_k"`
+	Threshold float64 `json:"threshold"`
+	Labels    string  `json:"labels"`
+}
+
+type Prediction struct {
+	Index int     `json:"index"`
+	Label string  `json:"label"`
+	Score float64 `json:"score"`
+}
+
+func (p *PostProcess) validate(model *Model) error {
+	if p.Output != "" {
+		if _, err := model.selectOutputs([]string{p.Output}); err != nil {
+			return err
+		}
+	}
+	if p.TopK < 0 {
+		return fmt.Errorf("top k can't be negative")
+	}
+	if p.Threshold < 0 || p.Threshold > 1 {
+		return fmt.Errorf("threshold must be between 0 and 1")
+	}
+	if p.Labels != "" {
+		labels := filepath.Clean(p.Labels)
+		if filepath.IsAbs(labels) || labels == ".." || strings.HasPrefix(labels, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("labels file %s is outside the model directory", p.Labels)
+		}
+		p.Labels = labels
+		// il file delle etichette può mancare sul peer che approva la transazione
+		if err := ensureModelFiles(model); err != nil {
+			return err
+		}
+		if _, err := readLabels(model, p.Labels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chiave dell'output da elaborare, il primo della firma se non indicato
+func (p *PostProcess) outputKey(model *Model) string {
+	if p.Output != "" {
+		return p.Output
+	}
+	return model.Outputs[0].Key
+}
+
+// verifica prima dell'esecuzione che l'output da elaborare sia tra quelli richiesti
+func (p *PostProcess) checkOutputs(model *Model, outputs []Data) error {
+	key := p.outputKey(model)
+	for _, output := range outputs {
+		if output.Key == key {
+			return nil
+		}
+	}
+	return fmt.Errorf("output %s needed for post-processing was not requested", key)
+}
+
+func readLabels(model *Model, path string) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(model.Location, path))
+	if err != nil {
+		return nil, fmt.Errorf("error reading labels file %s: %s", path, err)
+	}
+	var labels []string
+	for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+		labels = append(labels, strings.TrimSpace(line))
+	}
+	return labels, nil
+}
+
+// applica softmax, soglia e top-k alle righe dell'output, una per elemento del batch
+func (p *PostProcess) apply(model *Model, values interface{}, shape []int64) ([][]Prediction, error) {
+	if len(shape) == 0 {
+		return nil, fmt.Errorf("can't post-process a scalar output")
+	}
+
+	scores, err := toFloats(flatten(values).([]interface{}))
+	if err != nil {
+		return nil, err
+	}
+
+	classes := int(shape[len(shape)-1])
+	if classes == 0 || len(scores)%classes != 0 {
+		return nil, fmt.Errorf("output of %d values can't be split in rows of %d classes", len(scores), classes)
+	}
+
+	var labels []string
+	if p.Labels != "" {
+		labels, err = readLabels(model, p.Labels)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var predictions [][]Prediction
+	for start := 0; start < len(scores); start += classes {
+		row := scores[start : start+classes]
+		if p.Softmax {
+			row = softmax(row)
+		}
+
+		var rowPredictions []Prediction
+		for i, score := range row {
+			if score < p.Threshold {
+				continue
+			}
+			label := strconv.Itoa(i)
+			if i < len(labels) {
+				label = labels[i]
+			}
+			rowPredictions = append(rowPredictions, Prediction{Index: i, Label: label, Score: score})
+		}
+
+		sort.SliceStable(rowPredictions, func(i, j int) bool {
+			return rowPredictions[i].Score > rowPredictions[j].Score
+		})
+		if p.TopK > 0 && len(rowPredictions) > p.TopK {
+			rowPredictions = rowPredictions[:p.TopK]
+		}
+		predictions = append(predictions, rowPredictions)
+	}
+	return predictions, nil
+}
+
+func toFloats(values []interface{}) ([]float64, error) {
+	floats := make([]float64, len(values))
+	for i, value := range values {
+		v := reflect.ValueOf(value)
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			floats[i] = v.Float()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			floats[i] = float64(v.Int())
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			floats[i] = float64(v.Uint())
+		default:
+			return nil, fmt.Errorf("can't post-process values of type %s", v.Type())
+		}
+	}
+	return floats, nil
+}
+
+func softmax(row []float64) []float64 {
+	max := math.Inf(-1)
+	for _, v := range row {
+		max = math.Max(max, v)
+	}
+	var sum float64
+	result := make([]float64, len(row))
+	for i, v := range row {
+		result[i] = math.Exp(v - max)
+		sum += result[i]
+	}
+	for i := range result {
+		result[i] /= sum
+	}
+	return result
+}
+
+// imposta la post-elaborazione del modello, spec è un PostProcess in JSON. una stringa vuota la rimuove
+func (sc *SmartContract) SetPostProcessing(ctx CustomTransactionContextInterface, name string, spec string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		model.PostProcess = nil
+		return NewModelRepository(ctx).Update(model)
+	}
+
+	postProcess := new(PostProcess)
+	err = json.Unmarshal([]byte(spec), postProcess)
+	if err != nil {
+		return fmt.Errorf("error parsing post-processing spec: %s", err)
+	}
+
+	err = postProcess.validate(model)
+	if err != nil {
+		return err
+	}
+
+	model.PostProcess = postProcess
+	return NewModelRepository(ctx).Update(model)
+}
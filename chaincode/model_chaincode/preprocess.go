@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"strings"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+const (
+	PreprocessImage = "image"
+	PreprocessJSON  = "json"
+)
+
+// numero massimo di pixel di un'immagine inviata. le dimensioni sono lette dall'header prima
+// della decodifica, un file piccolo può dichiarare dimensioni che richiederebbero gigabyte di memoria
+const maxImagePixels = 4096 * 4096
+
+// conversione di un input inviato come immagine PNG/JPEG o documento JSON nel tensore
+// atteso dal modello. Width, Height e Channels, se 0, sono letti dalla forma [batch, h, w, c].
+// i pixel, tra 0 e 255, vengono riportati nell'intervallo [Min, Max] se diverso da [0, 0].
+// Fields indica l'ordine dei campi di un oggetto JSON
+type Preprocess struct {
+	Type     string   `json:"type"`
+	Width    int      `json:"width"`
+	Height   int      `json:"height"`
+	Channels int      `json:"channels"`
+	Resize   string   `json:"resize"`
+	Min      float64  `json:"min"`
+	Max      float64  `json:"max"`
+	Fields   []string `json:"fields,omitempty" metadata:",optional"`
+}
+
+func (p *Preprocess) validate(input Data) error {
+	switch p.Type {
+	case PreprocessImage:
+		shape := input.Shape
+		if len(shape) == 4 {
+			if p.Height == 0 {
+				p.Height = int(shape[1])
+			}
+			if p.Width == 0 {
+				p.Width = int(shape[2])
+			}
+			if p.Channels == 0 {
+				p.Channels = int(shape[3])
+			}
+		}
+		if p.Width <= 0 || p.Height <= 0 {
+			return fmt.Errorf("image size must be set for input %s with shape %v", input.Key, input.Shape)
+		}
+		if p.Channels != 1 && p.Channels != 3 {
+			return fmt.Errorf("images can have 1 or 3 channels, got %d", p.Channels)
+		}
+		if p.Resize == "" {
+			p.Resize = "bilinear"
+		}
+		if p.Resize != "bilinear" && p.Resize != "nearest" {
+			return fmt.Errorf("unknown resize method %s", p.Resize)
+		}
+		if p.Min > p.Max {
+			return fmt.Errorf("normalization range [%v, %v] is empty", p.Min, p.Max)
+		}
+	case PreprocessJSON:
+	default:
+		return fmt.Errorf("unknown preprocessing type %s", p.Type)
+	}
+
+	if _, err := encodeValues(input.DataType, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+// converte i byte ricevuti in quelli di un elemento del tensore input
+func (p *Preprocess) tensorBytes(data []byte, input Data) ([]byte, error) {
+	var values []float64
+	var err error
+
+	switch p.Type {
+	case PreprocessImage:
+		values, err = p.imageValues(data)
+	case PreprocessJSON:
+		values, err = p.jsonValues(data)
+	default:
+		err = fmt.Errorf("unknown preprocessing type %s", p.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if expected := itemElements(input.Shape); expected > 0 && int64(len(values)) != expected {
+		return nil, fmt.Errorf("input %s: preprocessing produced %d values, shape %v needs %d per item", input.Key, len(values), input.Shape, expected)
+	}
+	return encodeValues(input.DataType, values)
+}
+
+// numero di elementi di un singolo elemento del batch, -1 se la forma non è nota.
+// una prima dimensione fissa diversa da 1 non è quella del batch e fa parte dell'elemento
+func itemElements(shape []int64) int64 {
+	n := int64(1)
+	for i, dim := range shape {
+		if i == 0 && (dim == -1 || dim == 1) {
+			continue
+		}
+		if dim < 0 {
+			return -1
+		}
+		n *= dim
+	}
+	return n
+}
+
+func (p *Preprocess) imageValues(data []byte) ([]float64, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %s", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || int64(config.Width)*int64(config.Height) > maxImagePixels {
+		return nil, fmt.Errorf("image of %dx%d pixels exceeds the limit of %d pixels", config.Width, config.Height, maxImagePixels)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding image: %s", err)
+	}
+
+	bounds := img.Bounds()
+	scaleX := float64(bounds.Dx()) / float64(p.Width)
+	scaleY := float64(bounds.Dy()) / float64(p.Height)
+
+	values := make([]float64, 0, p.Width*p.Height*p.Channels)
+	for y := 0; y < p.Height; y++ {
+		for x := 0; x < p.Width; x++ {
+			// centro del pixel di destinazione nelle coordinate dell'immagine originale
+			srcX := (float64(x)+0.5)*scaleX - 0.5
+			srcY := (float64(y)+0.5)*scaleY - 0.5
+
+			var r, g, b float64
+			if p.Resize == "nearest" {
+				r, g, b = pixel(img, int(math.Round(srcX)), int(math.Round(srcY)))
+			} else {
+				r, g, b = bilinear(img, srcX, srcY)
+			}
+
+			if p.Channels == 1 {
+				values = append(values, p.normalize(0.299*r+0.587*g+0.114*b))
+			} else {
+				values = append(values, p.normalize(r), p.normalize(g), p.normalize(b))
+			}
+		}
+	}
+	return values, nil
+}
+
+func (p *Preprocess) normalize(v float64) float64 {
+	if p.Min == 0 && p.Max == 0 {
+		return v
+	}
+	return p.Min + v/255*(p.Max-p.Min)
+}
+
+// valori RGB tra 0 e 255 del pixel (x, y), limitato ai bordi dell'immagine
+func pixel(img image.Image, x int, y int) (float64, float64, float64) {
+	bounds := img.Bounds()
+	if x < 0 {
+		x = 0
+	}
+	if x >= bounds.Dx() {
+		x = bounds.Dx() - 1
+	}
+	if y < 0 {
+		y = 0
+	}
+	if y >= bounds.Dy() {
+		y = bounds.Dy() - 1
+	}
+	r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+	return float64(r) / 257, float64(g) / 257, float64(b) / 257
+}
+
+func bilinear(img image.Image, x float64, y float64) (float64, float64, float64) {
+	x0, y0 := math.Floor(x), math.Floor(y)
+	dx, dy := x-x0, y-y0
+
+	r00, g00, b00 := pixel(img, int(x0), int(y0))
+	r10, g10, b10 := pixel(img, int(x0)+1, int(y0))
+	r01, g01, b01 := pixel(img, int(x0), int(y0)+1)
+	r11, g11, b11 := pixel(img, int(x0)+1, int(y0)+1)
+
+	mix := func(v00, v10, v01, v11 float64) float64 {
+		top := v00*(1-dx) + v10*dx
+		bottom := v01*(1-dx) + v11*dx
+		return top*(1-dy) + bottom*dy
+	}
+	return mix(r00, r10, r01, r11), mix(g00, g10, g01, g11), mix(b00, b10, b01, b11)
+}
+
+// valori di un documento JSON: un numero, array annidati di numeri o un oggetto,
+// i cui campi sono presi nell'ordine di Fields
+func (p *Preprocess) jsonValues(data []byte) ([]float64, error) {
+	var document interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&document)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing JSON input: %s", err)
+	}
+
+	if object, ok := document.(map[string]interface{}); ok {
+		if len(p.Fields) == 0 {
+			return nil, fmt.Errorf("JSON objects need the list of fields in the preprocessing spec")
+		}
+		var fields []interface{}
+		for _, field := range p.Fields {
+			value, exists := object[field]
+			if !exists {
+				return nil, fmt.Errorf("missing field %s in JSON input", field)
+			}
+			fields = append(fields, value)
+		}
+		document = fields
+	}
+
+	var values []float64
+	err = appendJSONValues(document, &values)
+	return values, err
+}
+
+func appendJSONValues(document interface{}, values *[]float64) error {
+	switch v := document.(type) {
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return fmt.Errorf("invalid number %s in JSON input", v)
+		}
+		*values = append(*values, f)
+	case bool:
+		if v {
+			*values = append(*values, 1)
+		} else {
+			*values = append(*values, 0)
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := appendJSONValues(item, values); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported value %v in JSON input", v)
+	}
+	return nil
+}
+
+// codifica i valori in little endian nel tipo del tensore
+func encodeValues(dt tf.DataType, values []float64) ([]byte, error) {
+	var data interface{}
+
+	switch dt {
+	case tf.Float:
+		v := make([]float32, len(values))
+		for i := range values {
+			v[i] = float32(values[i])
+		}
+		data = v
+	case tf.Double:
+		data = values
+	case tf.Int8:
+		v := make([]int8, len(values))
+		for i := range values {
+			v[i] = int8(math.Round(values[i]))
+		}
+		data = v
+	case tf.Int16:
+		v := make([]int16, len(values))
+		for i := range values {
+			v[i] = int16(math.Round(values[i]))
+		}
+		data = v
+	case tf.Int32:
+		v := make([]int32, len(values))
+		for i := range values {
+			v[i] = int32(math.Round(values[i]))
+		}
+		data = v
+	case tf.Int64:
+		v := make([]int64, len(values))
+		for i := range values {
+			v[i] = int64(math.Round(values[i]))
+		}
+		data = v
+	case tf.Uint8:
+		v := make([]uint8, len(values))
+		for i := range values {
+			v[i] = uint8(math.Round(values[i]))
+		}
+		data = v
+	case tf.Uint16:
+		v := make([]uint16, len(values))
+		for i := range values {
+			v[i] = uint16(math.Round(values[i]))
+		}
+		data = v
+	case tf.Uint32:
+		v := make([]uint32, len(values))
+		for i := range values {
+			v[i] = uint32(math.Round(values[i]))
+		}
+		data = v
+	case tf.Uint64:
+		v := make([]uint64, len(values))
+		for i := range values {
+			v[i] = uint64(math.Round(values[i]))
+		}
+		data = v
+	case tf.Bool:
+		v := make([]bool, len(values))
+		for i := range values {
+			v[i] = values[i] != 0
+		}
+		data = v
+	default:
+		return nil, fmt.Errorf("preprocessing doesn't support datatype %s", dataTypeName(dt))
+	}
+
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.LittleEndian, data)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// imposta la conversione dell'input key del modello, spec è un Preprocess in JSON.
+// una stringa vuota la rimuove
+func (sc *SmartContract) SetPreprocessing(ctx CustomTransactionContextInterface, name string, key string, spec string) error {
+	model, err := getOwnedModel(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	input, err := model.input(key)
+	if err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(spec) == "" {
+		delete(model.Preprocess, key)
+		return NewModelRepository(ctx).Update(model)
+	}
+
+	preprocess := new(Preprocess)
+	err = json.Unmarshal([]byte(spec), preprocess)
+	if err != nil {
+		return fmt.Errorf("error parsing preprocessing spec: %s", err)
+	}
+
+	err = preprocess.validate(*input)
+	if err != nil {
+		return err
+	}
+
+	if model.Preprocess == nil {
+		model.Preprocess = make(map[string]*Preprocess)
+	}
+	model.Preprocess[key] = preprocess
+	return NewModelRepository(ctx).Update(model)
+}
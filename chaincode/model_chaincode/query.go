@@ -0,0 +1,43 @@
+package main
+
+// condizioni che identificano i documenti dei modelli tra le chiavi del world state
+var modelDocument = selector{
+	"hash":     map[string]interface{}{"$exists": true},
+	"location": map[string]interface{}{"$exists": true},
+}
+
+// pagina di una query con selettore. Bookmark è vuoto dopo l'ultima pagina
+type ModelQueryPage struct {
+	Models   []*ModelResult `json:"models"`
+	Bookmark string         `json:"bookmark"`
+	Fetched  int            `json:"fetched"`
+}
+
+// ricerca dei modelli con un selettore Mango di CouchDB, ad esempio
+// {"metadata.task": "image-classification", "access_policy": {"$in": ["open", "paid"]}}.
+// va eseguita come query, le query paginate non sono permesse nelle transazioni
+func (sc *SmartContract) QueryModels(ctx CustomTransactionContextInterface, query string, pageSize int, bookmark string) (*ModelQueryPage, error) {
+	s, err := parseSelector(query)
+	if err != nil {
+		return nil, err
+	}
+	size, err := checkPageSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := querySelector(ctx.GetStub(), s, modelDocument, size, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	result := ModelQueryPage{Models: []*ModelResult{}, Bookmark: page.Bookmark, Fetched: len(page.Keys)}
+	for _, value := range page.Values {
+		model, err := modelFromBytes(value)
+		if err != nil {
+			return nil, err
+		}
+		result.Models = append(result.Models, model.result())
+	}
+	return &result, nil
+}
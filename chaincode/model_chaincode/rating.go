@@ -0,0 +1,265 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// la valutazione aggregata e la voce dell'indice byRating sono separate dal record del modello,
+// così le recensioni non creano conflitti MVCC con RunModel e le altre transazioni che lo leggono
+const (
+	reviewPrefix = "review" // [model, hash, utente] -> Review
+	ratingPrefix = "rating" // [model] -> Rating
+)
+
+const maxCommentLength = 1024
+
+// recensione di un utente per una versione del modello, identificata dall'hash
+type Review struct {
+	Model     string `json:"model"`
+	Version   string `json:"version"`
+	User      string `json:"user"`
+	Stars     int    `json:"stars"`
+	Comment   string `json:"comment,omitempty" metadata:",optional"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// valutazione aggregata delle recensioni. Stars conta le recensioni per numero di stelle, da 1 a 5
+type Rating struct {
+	Count   int     `json:"count"`
+	Total   int     `json:"total"`
+	Stars   [5]int  `json:"stars"`
+	Average float64 `json:"average"`
+}
+
+func (r *Rating) add(stars int) {
+	r.Count++
+	r.Total += stars
+	r.Stars[stars-1]++
+	r.Average = math.Round(float64(r.Total)/float64(r.Count)*100) / 100
+}
+
+// voce dell'indice per valutazione: le chiavi sono ordinate dalla media più alta,
+// i modelli senza recensioni vengono per ultimi
+func ratingIndexKey(stub shim.ChaincodeStubInterface, name string, rating *Rating) (string, error) {
+	score := "999"
+	if rating != nil && rating.Count > 0 {
+		score = fmt.Sprintf("%03d", 500-int(math.Round(rating.Average*100)))
+	}
+	return stub.CreateCompositeKey(ratingIndex, []string{score, name})
+}
+
+// valutazione aggregata del modello, vuota se non ha recensioni
+func getRating(stub shim.ChaincodeStubInterface, name string) (*Rating, error) {
+	key, err := stub.CreateCompositeKey(ratingPrefix, []string{name})
+	if err != nil {
+		return nil, err
+	}
+	ratingBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	rating := new(Rating)
+	if ratingBytes == nil {
+		return rating, nil
+	}
+	err = json.Unmarshal(ratingBytes, rating)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling rating: %s", err)
+	}
+	return rating, nil
+}
+
+// scrive la valutazione aggregata e sposta la voce dell'indice byRating da quella di previous
+func putRating(stub shim.ChaincodeStubInterface, name string, previous *Rating, rating *Rating) error {
+	key, err := stub.CreateCompositeKey(ratingPrefix, []string{name})
+	if err != nil {
+		return err
+	}
+	ratingBytes, err := json.Marshal(rating)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(key, ratingBytes)
+	if err != nil {
+		return err
+	}
+
+	oldKey, err := ratingIndexKey(stub, name, previous)
+	if err != nil {
+		return err
+	}
+	newKey, err := ratingIndexKey(stub, name, rating)
+	if err != nil {
+		return err
+	}
+	if oldKey != newKey {
+		err = stub.DelState(oldKey)
+		if err != nil {
+			return err
+		}
+	}
+	return stub.PutState(newKey, []byte(name))
+}
+
+// l'uso della versione hash del modello è registrato da RunModel sotto le chiavi caller,
+// le esecuzioni precedenti alle statistiche sono presenti solo negli eventi ModelUse e non vengono considerate
+func hasUsedModel(ctx CustomTransactionContextInterface, model string, user string, hash string) (bool, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(callerIndex, []string{model, user, hash})
+	if err != nil {
+		return false, err
+	}
+	used, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return false, err
+	}
+	return used != nil, nil
+}
+
+// recensisce la versione corrente del modello con 1-5 stelle. possono recensire solo gli utenti che
+// hanno eseguito questa versione del modello, una volta per versione
+func (sc *SmartContract) RateModel(ctx CustomTransactionContextInterface, name string, stars int, comment string) error {
+	model := ctx.Model()
+
+	userID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return err
+	}
+	if userID == model.Creator {
+		return fmt.Errorf("the owner of model %s can't review it", name)
+	}
+
+	if stars < 1 || stars > 5 {
+		return fmt.Errorf("stars must be between 1 and 5, got %d", stars)
+	}
+	if len(comment) > maxCommentLength {
+		return fmt.Errorf("comment longer than %d characters", maxCommentLength)
+	}
+
+	used, err := hasUsedModel(ctx, model.Name, userID, model.Hash)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return fmt.Errorf("user %s has never run version %s of model %s", userID, model.Hash, name)
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(reviewPrefix, []string{model.Name, model.Hash, userID})
+	if err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("user %s already reviewed version %s of model %s", userID, model.Hash, name)
+	}
+
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	review := Review{
+		Model:     model.Name,
+		Version:   model.Hash,
+		User:      userID,
+		Stars:     stars,
+		Comment:   comment,
+		Timestamp: timestamp.GetSeconds(),
+	}
+	reviewBytes, err := json.Marshal(review)
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(key, reviewBytes)
+	if err != nil {
+		return err
+	}
+
+	previous, err := getRating(ctx.GetStub(), model.Name)
+	if err != nil {
+		return err
+	}
+	rating := *previous
+	rating.add(stars)
+	return putRating(ctx.GetStub(), model.Name, previous, &rating)
+}
+
+// valutazione del modello, di tutte le versioni se version è vuota
+func (sc *SmartContract) GetModelRating(ctx CustomTransactionContextInterface, name string, version string) (*Rating, error) {
+	model := ctx.Model()
+
+	if version == "" {
+		return getRating(ctx.GetStub(), model.Name)
+	}
+
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(reviewPrefix, []string{model.Name, version})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	rating := new(Rating)
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+		review := new(Review)
+		err = json.Unmarshal(entry.Value, review)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling review: %s", err)
+		}
+		rating.add(review.Stars)
+	}
+	return rating, nil
+}
+
+type ReviewPage struct {
+	Reviews  []*Review `json:"reviews"`
+	Bookmark string    `json:"bookmark"`
+	Fetched  int       `json:"fetched"`
+}
+
+// recensioni del modello, della sola versione indicata se version non è vuota.
+// va eseguita come query, le query paginate non sono permesse nelle transazioni
+func (sc *SmartContract) ListReviews(ctx CustomTransactionContextInterface, name string, version string, pageSize int, bookmark string) (*ReviewPage, error) {
+	model := ctx.Model()
+
+	size, err := checkPageSize(pageSize)
+	if err != nil {
+		return nil, err
+	}
+
+	attrs := []string{model.Name}
+	if version != "" {
+		attrs = append(attrs, version)
+	}
+	iterator, metadata, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(reviewPrefix, attrs, size, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	page := ReviewPage{Reviews: []*Review{}, Bookmark: metadata.GetBookmark(), Fetched: int(metadata.GetFetchedRecordsCount())}
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+		review := new(Review)
+		err = json.Unmarshal(entry.Value, review)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling review: %s", err)
+		}
+		page.Reviews = append(page.Reviews, review)
+	}
+	if page.Fetched < int(size) {
+		page.Bookmark = ""
+	}
+	return &page, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// indici secondari dei modelli, chiavi composte che terminano con il nome del modello
+const (
+	devIndex    = "byDev"
+	tagIndex    = "byTag"
+	statusIndex = "byStatus"
+	ratingIndex = "byRating" // scritto da putRating, la chiave dipende dalla valutazione e non dal modello
+)
+
+// unico punto di accesso ai modelli nel world state. il record è salvato sotto il nome
+// del modello, le voci degli indici contengono solo il nome e vengono aggiornate a ogni scrittura
+type ModelRepository struct {
+	stub shim.ChaincodeStubInterface
+}
+
+func NewModelRepository(ctx CustomTransactionContextInterface) *ModelRepository {
+	return &ModelRepository{stub: ctx.GetStub()}
+}
+
+// restituisce nil se il modello non esiste
+func (r *ModelRepository) Get(name string) (*Model, error) {
+	modelBytes, err := r.stub.GetState(name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to interact with world state: %s", err)
+	}
+	if modelBytes == nil {
+		return nil, nil
+	}
+	model, err := modelFromBytes(modelBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error unmarshaling model %s", err)
+	}
+	return model, nil
+}
+
+func (r *ModelRepository) Create(model *Model) error {
+	existing, err := r.stub.GetState(model.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("cannot create world state pair with key %s. Already exists", model.Name)
+	}
+	err = r.save(nil, model)
+	if err != nil {
+		return err
+	}
+	// il nuovo modello compare tra quelli senza recensioni
+	key, err := ratingIndexKey(r.stub, model.Name, nil)
+	if err != nil {
+		return err
+	}
+	return r.stub.PutState(key, []byte(model.Name))
+}
+
+// scrive il modello e sposta le voci degli indici che dipendono da campi modificati
+func (r *ModelRepository) Update(model *Model) error {
+	previous, err := r.Get(model.Name)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		return fmt.Errorf("no model with key %s found", model.Name)
+	}
+	return r.save(previous, model)
+}
+
+func (r *ModelRepository) Delete(model *Model) error {
+	keys, err := r.indexKeys(model)
+	if err != nil {
+		return err
+	}
+	rating, err := r.Rating(model.Name)
+	if err != nil {
+		return err
+	}
+	ratingKey, err := ratingIndexKey(r.stub, model.Name, rating)
+	if err != nil {
+		return err
+	}
+	keys = append(keys, ratingKey)
+	for _, key := range keys {
+		err = r.stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return r.stub.DelState(model.Name)
+}
+
+func (r *ModelRepository) save(previous *Model, model *Model) error {
+	modelBytes, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+	err = r.stub.PutState(model.Name, modelBytes)
+	if err != nil {
+		return err
+	}
+
+	keys, err := r.indexKeys(model)
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, key := range keys {
+		current[key] = true
+		err = r.stub.PutState(key, []byte(model.Name))
+		if err != nil {
+			return err
+		}
+	}
+
+	if previous == nil {
+		return nil
+	}
+	oldKeys, err := r.indexKeys(previous)
+	if err != nil {
+		return err
+	}
+	for _, key := range oldKeys {
+		if !current[key] {
+			err = r.stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (r *ModelRepository) indexKeys(model *Model) ([]string, error) {
+	attributes := [][]string{
+		{devIndex, model.Creator, model.Name},
+		{statusIndex, model.status(), model.Name},
+	}
+	for _, tag := range model.Tags {
+		attributes = append(attributes, []string{tagIndex, tag, model.Name})
+	}
+
+	var keys []string
+	for _, attrs := range attributes {
+		key, err := r.stub.CreateCompositeKey(attrs[0], attrs[1:])
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (r *ModelRepository) Rating(name string) (*Rating, error) {
+	return getRating(r.stub, name)
+}
+
+// modello per il client con la valutazione aggregata
+func (r *ModelRepository) Result(model *Model) (*ModelResult, error) {
+	rating, err := r.Rating(model.Name)
+	if err != nil {
+		return nil, err
+	}
+	result := model.result()
+	result.Rating = rating
+	return result, nil
+}
+
+func (r *ModelRepository) ByDev(creator string) ([]*Model, error) {
+	return r.byIndex(devIndex, creator)
+}
+
+func (r *ModelRepository) ByTag(tag string) ([]*Model, error) {
+	return r.byIndex(tagIndex, tag)
+}
+
+func (r *ModelRepository) ByStatus(status string) ([]*Model, error) {
+	return r.byIndex(statusIndex, status)
+}
+
+// legge i modelli a cui puntano le voci dell'indice. le voci byDev scritte prima del
+// repository contengono una copia del modello, ma viene usato solo il nome nella chiave
+func (r *ModelRepository) byIndex(index string, value string) ([]*Model, error) {
+	iterator, _, _, err := r.scan(index, []string{value}, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var models []*Model
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+		model, err := r.entryModel(index, entry.Key, entry.Value)
+		if err != nil {
+			return nil, err
+		}
+		if model != nil {
+			models = append(models, model)
+		}
+	}
+	return models, nil
+}
+
+// riscrive le voci degli indici di tutti i modelli, per i modelli salvati prima del repository
+// o prima dell'aggiunta di un indice, come quello delle valutazioni
+func (sc *SmartContract) RebuildIndexes(ctx CustomTransactionContextInterface) (int, error) {
+	err := checkAdmin(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	iterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return 0, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	repository := NewModelRepository(ctx)
+	count := 0
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return 0, fmt.Errorf("error reading iterator: %s", err)
+		}
+		model, err := modelFromBytes(entry.Value)
+		if err != nil {
+			return 0, fmt.Errorf("error unmarshaling: %s", err)
+		}
+		err = repository.save(nil, model)
+		if err != nil {
+			return 0, err
+		}
+		rating, err := repository.Rating(model.Name)
+		if err != nil {
+			return 0, err
+		}
+		ratingKey, err := ratingIndexKey(ctx.GetStub(), model.Name, rating)
+		if err != nil {
+			return 0, err
+		}
+		err = ctx.GetStub().PutState(ratingKey, []byte(model.Name))
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func modelResults(models []*Model) []*ModelResult {
+	results := []*ModelResult{}
+	for _, model := range models {
+		results = append(results, model.result())
+	}
+	return results
+}
+
+func (sc *SmartContract) GetModelsByDev(ctx CustomTransactionContextInterface, username string) ([]*ModelResult, error) {
+	models, err := NewModelRepository(ctx).ByDev(username)
+	if err != nil {
+		return nil, err
+	}
+	return modelResults(models), nil
+}
+
+func (sc *SmartContract) GetModelsByTag(ctx CustomTransactionContextInterface, tag string) ([]*ModelResult, error) {
+	models, err := NewModelRepository(ctx).ByTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	return modelResults(models), nil
+}
+
+func (sc *SmartContract) GetModelsByStatus(ctx CustomTransactionContextInterface, status string) ([]*ModelResult, error) {
+	models, err := NewModelRepository(ctx).ByStatus(status)
+	if err != nil {
+		return nil, err
+	}
+	return modelResults(models), nil
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// valutazione dei selettori Mango di CouchDB, usata al posto delle rich query quando il peer
+// usa LevelDB. supporta l'uguaglianza implicita e gli operatori $eq, $ne, $gt, $gte, $lt, $lte,
+// $in, $nin, $exists, $regex, $size, $all, $elemMatch, $and, $or, $nor e $not.
+// i confronti tra tipi diversi non sono soddisfatti e l'ordinamento non è supportato
+type selector map[string]interface{}
+
+func parseSelector(query string) (selector, error) {
+	var s selector
+	err := json.Unmarshal([]byte(query), &s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing selector: %s", err)
+	}
+	if s == nil {
+		return nil, errors.New("empty selector")
+	}
+	// accetta anche una query completa nella forma {"selector": {...}}
+	if inner, exists := s["selector"].(map[string]interface{}); exists && len(s) == 1 {
+		s = inner
+	}
+	return s, nil
+}
+
+// con CouchDB le rich query leggono anche i documenti delle chiavi composte, che iniziano con \x00,
+// come le voci byDev scritte prima di ModelRepository con una copia completa del modello.
+// la lettura con LevelDB considera già solo le chiavi semplici
+var simpleKeyDocument = map[string]interface{}{"_id": map[string]interface{}{"$regex": "^[^\\x00]"}}
+
+// query CouchDB con il selettore richiesto e le condizioni che identificano il tipo di documento
+func (s selector) query(kind selector) (string, error) {
+	queryBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"$and": []interface{}{map[string]interface{}(s), map[string]interface{}(kind), simpleKeyDocument}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryBytes), nil
+}
+
+func (s selector) match(doc interface{}) (bool, error) {
+	for field, condition := range s {
+		var ok bool
+		var err error
+		switch field {
+		case "$and", "$or", "$nor":
+			ok, err = matchCombination(field, condition, doc)
+		case "$not":
+			sub, isMap := condition.(map[string]interface{})
+			if !isMap {
+				return false, errors.New("$not needs a selector")
+			}
+			ok, err = selector(sub).match(doc)
+			ok = !ok
+		default:
+			value, exists := lookupField(doc, field)
+			ok, err = matchCondition(condition, value, exists)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchCombination(op string, condition interface{}, doc interface{}) (bool, error) {
+	subs, isArray := condition.([]interface{})
+	if !isArray {
+		return false, fmt.Errorf("%s needs an array of selectors", op)
+	}
+	matched := 0
+	for _, sub := range subs {
+		subSelector, isMap := sub.(map[string]interface{})
+		if !isMap {
+			return false, fmt.Errorf("%s needs an array of selectors", op)
+		}
+		ok, err := selector(subSelector).match(doc)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	switch op {
+	case "$and":
+		return matched == len(subs), nil
+	case "$or":
+		return matched > 0, nil
+	}
+	return matched == 0, nil
+}
+
+// campo del documento indicato con la notazione a punti, come metadata.task
+func lookupField(doc interface{}, field string) (interface{}, bool) {
+	value := doc
+	for _, part := range strings.Split(field, ".") {
+		object, isMap := value.(map[string]interface{})
+		if !isMap {
+			return nil, false
+		}
+		value, isMap = object[part]
+		if !isMap {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// una condizione è un valore da confrontare per uguaglianza o un oggetto di operatori
+func matchCondition(condition interface{}, value interface{}, exists bool) (bool, error) {
+	operators, isMap := condition.(map[string]interface{})
+	if !isMap || !hasOperators(operators) {
+		return exists && equalValues(condition, value), nil
+	}
+
+	for op, arg := range operators {
+		ok, err := matchOperator(op, arg, value, exists)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func hasOperators(object map[string]interface{}) bool {
+	for key := range object {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+var selectorOperators = map[string]bool{
+	"$eq": true, "$ne": true, "$gt": true, "$gte": true, "$lt": true, "$lte": true, "$in": true, "$nin": true,
+	"$exists": true, "$regex": true, "$size": true, "$all": true, "$elemMatch": true, "$not": true,
+}
+
+func matchOperator(op string, arg interface{}, value interface{}, exists bool) (bool, error) {
+	if !selectorOperators[op] {
+		return false, fmt.Errorf("unsupported operator %s", op)
+	}
+
+	switch op {
+	case "$exists":
+		want, isBool := arg.(bool)
+		if !isBool {
+			return false, errors.New("$exists needs a boolean")
+		}
+		return exists == want, nil
+	case "$ne":
+		return !exists || !equalValues(arg, value), nil
+	case "$nin":
+		values, isArray := arg.([]interface{})
+		if !isArray {
+			return false, errors.New("$nin needs an array")
+		}
+		for _, v := range values {
+			if exists && equalValues(v, value) {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$not":
+		ok, err := matchCondition(arg, value, exists)
+		return !ok, err
+	}
+
+	if !exists {
+		return false, nil
+	}
+
+	switch op {
+	case "$eq":
+		return equalValues(arg, value), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		cmp, comparable := compareValues(value, arg)
+		if !comparable {
+			return false, nil
+		}
+		switch op {
+		case "$gt":
+			return cmp > 0, nil
+		case "$gte":
+			return cmp >= 0, nil
+		case "$lt":
+			return cmp < 0, nil
+		}
+		return cmp <= 0, nil
+	case "$in":
+		values, isArray := arg.([]interface{})
+		if !isArray {
+			return false, errors.New("$in needs an array")
+		}
+		for _, v := range values {
+			if equalValues(v, value) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$regex":
+		pattern, isString := arg.(string)
+		if !isString {
+			return false, errors.New("$regex needs a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, fmt.Errorf("invalid $regex: %s", err)
+		}
+		s, isString := value.(string)
+		return isString && re.MatchString(s), nil
+	case "$size":
+		size, isNumber := arg.(float64)
+		array, isArray := value.([]interface{})
+		if !isNumber {
+			return false, errors.New("$size needs a number")
+		}
+		return isArray && float64(len(array)) == size, nil
+	case "$all":
+		values, isArray := arg.([]interface{})
+		array, valueIsArray := value.([]interface{})
+		if !isArray {
+			return false, errors.New("$all needs an array")
+		}
+		if !valueIsArray {
+			return false, nil
+		}
+		for _, v := range values {
+			found := false
+			for _, element := range array {
+				if equalValues(v, element) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false, nil
+			}
+		}
+		return true, nil
+	case "$elemMatch":
+		array, isArray := value.([]interface{})
+		if !isArray {
+			return false, nil
+		}
+		for _, element := range array {
+			var ok bool
+			var err error
+			if sub, isMap := arg.(map[string]interface{}); isMap && !hasOperators(sub) {
+				ok, err = selector(sub).match(element)
+			} else {
+				ok, err = matchCondition(arg, element, true)
+			}
+			if err != nil {
+				return false, err
+			}
+			if ok {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, nil
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aBytes) == string(bBytes)
+}
+
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+// risultato di una query con selettore: i documenti corrispondenti e il bookmark della pagina successiva
+type selectorPage struct {
+	Keys     []string
+	Values   [][]byte
+	Bookmark string
+}
+
+// rich query di CouchDB con paginazione. se il peer usa LevelDB i documenti delle chiavi semplici
+// vengono letti in ordine di chiave e filtrati con il selettore, e il bookmark è l'ultima chiave restituita
+func querySelector(stub shim.ChaincodeStubInterface, s selector, kind selector, pageSize int32, bookmark string) (*selectorPage, error) {
+	query, err := s.query(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, metadata, err := stub.GetQueryResultWithPagination(query, pageSize, bookmark)
+	if err == nil {
+		defer iterator.Close()
+		page := &selectorPage{Bookmark: metadata.GetBookmark()}
+		for iterator.HasNext() {
+			entry, err := iterator.Next()
+			if err != nil {
+				return nil, fmt.Errorf("error reading iterator: %s", err)
+			}
+			page.Keys = append(page.Keys, entry.Key)
+			page.Values = append(page.Values, entry.Value)
+		}
+		if metadata.GetFetchedRecordsCount() < pageSize {
+			page.Bookmark = ""
+		}
+		return page, nil
+	}
+	if !strings.Contains(err.Error(), "not supported for leveldb") {
+		return nil, fmt.Errorf("error running query: %s", err)
+	}
+
+	return scanSelector(stub, selector{"$and": []interface{}{map[string]interface{}(s), map[string]interface{}(kind)}}, pageSize, bookmark)
+}
+
+func scanSelector(stub shim.ChaincodeStubInterface, s selector, pageSize int32, bookmark string) (*selectorPage, error) {
+	start := ""
+	if bookmark != "" {
+		start = bookmark + "\x00"
+	}
+	iterator, err := stub.GetStateByRange(start, "")
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	page := new(selectorPage)
+	for iterator.HasNext() {
+		if len(page.Keys) == int(pageSize) {
+			page.Bookmark = page.Keys[len(page.Keys)-1]
+			break
+		}
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+
+		var doc interface{}
+		if json.Unmarshal(entry.Value, &doc) != nil {
+			continue
+		}
+		ok, err := s.match(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			page.Keys = append(page.Keys, entry.Key)
+			page.Values = append(page.Values, entry.Value)
+		}
+	}
+	return page, nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+	corepb "github.com/galeone/tensorflow/tensorflow/go/core/protobuf/for_core_protos_go_proto"
+	"google.golang.org/protobuf/proto"
+)
+
+const servingTag = "serve"
+const servingSignature = "serving_default"
+
+// definizione di un tensore inviata dal client, con il tipo indicato per nome.
+// i campi vuoti mantengono i valori letti dalla firma del SavedModel
+type TensorDef struct {
+	Key      string  `json:"key"`
+	Name     string  `json:"name"`
+	DataType string  `json:"datatype"`
+	Shape    []int64 `json:"shape"`
+	Idx      *int    `json:"idx"`
+}
+
+// firma letta da saved_model.pb, nomi dei nodi del grafo e versione di TensorFlow che l'ha salvato
+type savedSignature struct {
+	Inputs    []Data
+	Outputs   []Data
+	Nodes     map[string]bool
+	TFVersion string
+}
+
+// legge la firma serving_default del meta graph con tag serve da saved_model.pb in dir.
+// restituisce nil se il modello non contiene il file
+func readSignature(dir string) (*savedSignature, error) {
+	pb, err := os.ReadFile(filepath.Join(dir, "saved_model.pb"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	savedModel := new(corepb.SavedModel)
+	err = proto.Unmarshal(pb, savedModel)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing saved_model.pb: %s", err)
+	}
+
+	for _, metaGraph := range savedModel.GetMetaGraphs() {
+		if !hasTag(metaGraph.GetMetaInfoDef().GetTags(), servingTag) {
+			continue
+		}
+
+		signature := &savedSignature{Nodes: make(map[string]bool), TFVersion: metaGraph.GetMetaInfoDef().GetTensorflowVersion()}
+		for _, node := range metaGraph.GetGraphDef().GetNode() {
+			signature.Nodes[node.GetName()] = true
+		}
+
+		def, exists := metaGraph.GetSignatureDef()[servingSignature]
+		if !exists {
+			return signature, nil
+		}
+
+		signature.Inputs, err = tensorsFromProto(def.GetInputs())
+		if err != nil {
+			return nil, err
+		}
+		signature.Outputs, err = tensorsFromProto(def.GetOutputs())
+		if err != nil {
+			return nil, err
+		}
+		return signature, nil
+	}
+	return nil, fmt.Errorf("no meta graph with tag %s in saved_model.pb", servingTag)
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// converte i TensorInfo della firma, ordinati per chiave
+func tensorsFromProto(infos map[string]*corepb.TensorInfo) ([]Data, error) {
+	var keys []string
+	for key := range infos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var tensors []Data
+	for _, key := range keys {
+		info := infos[key]
+		name, idx, err := splitTensorName(info.GetName())
+		if err != nil {
+			return nil, err
+		}
+
+		// forma vuota e non nil per gli scalari, serializzata come []
+		shape := []int64{}
+		for _, dim := range info.GetTensorShape().GetDim() {
+			shape = append(shape, dim.GetSize())
+		}
+
+		tensors = append(tensors, Data{
+			Key:      key,
+			Name:     name,
+			DataType: tf.DataType(info.GetDtype()),
+			Shape:    shape,
+			Idx:      idx,
+		})
+	}
+	return tensors, nil
+}
+
+// separa il nome di un tensore nella forma op:idx
+func splitTensorName(tensorName string) (string, int, error) {
+	i := strings.LastIndex(tensorName, ":")
+	if i < 0 {
+		return tensorName, 0, nil
+	}
+	idx, err := strconv.Atoi(tensorName[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid tensor name %s", tensorName)
+	}
+	return tensorName[:i], idx, nil
+}
+
+// converte le definizioni dei tensori inviate dal client. s può contenere
+// un singolo oggetto, come in inputdef.json, un array, oppure essere vuota
+func parseTensorDefs(s string) ([]TensorDef, error) {
+	var defs []TensorDef
+
+	trimmed := strings.TrimSpace(s)
+	if trimmed == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(trimmed, "[") {
+		err := json.Unmarshal([]byte(trimmed), &defs)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing tensor definitions: %s", err)
+		}
+	} else {
+		def := TensorDef{}
+		err := json.Unmarshal([]byte(trimmed), &def)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing tensor definition: %s", err)
+		}
+		defs = append(defs, def)
+	}
+	return defs, nil
+}
+
+// applica le definizioni del client ai tensori letti dalla firma. una definizione corrisponde
+// a un tensore della firma per chiave o per nome dell'operazione, altrimenti viene aggiunta
+// e l'operazione deve esistere nel grafo
+func mergeSignature(discovered []Data, overrides []TensorDef, nodes map[string]bool) ([]Data, error) {
+	tensors := make([]Data, len(discovered))
+	copy(tensors, discovered)
+
+	for _, def := range overrides {
+		i := findTensor(tensors, def)
+
+		if i < 0 {
+			if def.Name == "" {
+				return nil, fmt.Errorf("tensor %s not found in model signature", def.Key)
+			}
+			if nodes != nil && !nodes[def.Name] {
+				return nil, fmt.Errorf("op %s not found in model graph", def.Name)
+			}
+			if def.DataType == "" {
+				return nil, fmt.Errorf("missing datatype for tensor %s", def.Name)
+			}
+			tensors = append(tensors, Data{Key: def.Key, Name: def.Name, Shape: []int64{}})
+			i = len(tensors) - 1
+			if tensors[i].Key == "" {
+				tensors[i].Key = def.Name
+			}
+		}
+
+		if def.Name != "" {
+			if nodes != nil && !nodes[def.Name] {
+				return nil, fmt.Errorf("op %s not found in model graph", def.Name)
+			}
+			tensors[i].Name = def.Name
+		}
+		if def.DataType != "" {
+			dataType, exists := tfTypes[def.DataType]
+			if !exists {
+				return nil, fmt.Errorf("unknown datatype %s for tensor %s", def.DataType, tensors[i].Key)
+			}
+			tensors[i].DataType = dataType
+		}
+		if def.Shape != nil {
+			tensors[i].Shape = def.Shape
+		}
+		if def.Idx != nil {
+			tensors[i].Idx = *def.Idx
+		}
+	}
+
+	if len(tensors) == 0 {
+		return nil, fmt.Errorf("no tensor defined")
+	}
+
+	keys := make(map[string]bool)
+	for _, tensor := range tensors {
+		if keys[tensor.Key] {
+			return nil, fmt.Errorf("duplicate tensor key %s", tensor.Key)
+		}
+		keys[tensor.Key] = true
+	}
+	return tensors, nil
+}
+
+func findTensor(tensors []Data, def TensorDef) int {
+	for i, tensor := range tensors {
+		if def.Key != "" && tensor.Key == def.Key {
+			return i
+		}
+	}
+	for i, tensor := range tensors {
+		if def.Key == "" && def.Name != "" && tensor.Name == def.Name {
+			if def.Idx == nil || *def.Idx == tensor.Idx {
+				return i
+			}
+		}
+	}
+	return -1
+}
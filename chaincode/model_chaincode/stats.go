@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// le statistiche non vengono aggiornate con letture e scritture di contatori, che farebbero
+// fallire per conflitto MVCC le esecuzioni concorrenti dello stesso modello: ogni transazione
+// scrive una propria voce sotto chiavi che includono il txID, e le query le aggregano
+const (
+	usageIndex    = "usage"    // [model, giorno, txID] -> UsageRecord
+	earningsIndex = "earnings" // [creatore, giorno, txID] -> UsageRecord
+	callerIndex   = "caller"   // [model, utente, hash] -> giorno dell'ultimo uso
+)
+
+// giorni con almeno una voce negli indici usage ed earnings, [model o creatore, giorno] -> 0.
+// Fabric non permette query per intervallo sulle chiavi composte, quindi le query leggono i giorni
+// attivi e poi le voci di ciascun giorno nell'intervallo, senza scorrere tutto lo storico
+func dayIndex(index string) string {
+	return index + "Day"
+}
+
+const (
+	UsageRun     = "run"
+	UsageLicense = "license"
+)
+
+const dayLayout = "2006-01-02"
+
+// uso di un modello in una transazione. Runs è il numero di elementi eseguiti,
+// Earned i token ricevuti dal creatore
+type UsageRecord struct {
+	Model   string `json:"model"`
+	Creator string `json:"creator"`
+	User    string `json:"user"`
+	Kind    string `json:"kind"`
+	Runs    int    `json:"runs"`
+	Earned  int    `json:"earned"`
+}
+
+// registra l'uso del modello nella transazione corrente
+func recordUsage(ctx CustomTransactionContextInterface, model *Model, user string, kind string, runs int, earned int) error {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return err
+	}
+	day := time.Unix(timestamp.GetSeconds(), 0).UTC().Format(dayLayout)
+	txID := ctx.GetStub().GetTxID()
+
+	record := UsageRecord{Model: model.Name, Creator: model.Creator, User: user, Kind: kind, Runs: runs, Earned: earned}
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	usageKey, err := ctx.GetStub().CreateCompositeKey(usageIndex, []string{model.Name, day, txID})
+	if err != nil {
+		return err
+	}
+	err = ctx.GetStub().PutState(usageKey, recordBytes)
+	if err != nil {
+		return err
+	}
+	err = putDay(ctx, usageIndex, model.Name, day)
+	if err != nil {
+		return err
+	}
+
+	if earned > 0 {
+		earningsKey, err := ctx.GetStub().CreateCompositeKey(earningsIndex, []string{model.Creator, day, txID})
+		if err != nil {
+			return err
+		}
+		err = ctx.GetStub().PutState(earningsKey, recordBytes)
+		if err != nil {
+			return err
+		}
+		err = putDay(ctx, earningsIndex, model.Creator, day)
+		if err != nil {
+			return err
+		}
+	}
+
+	if kind != UsageRun {
+		return nil
+	}
+	callerKey, err := ctx.GetStub().CreateCompositeKey(callerIndex, []string{model.Name, user, model.Hash})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(callerKey, []byte(day))
+}
+
+// segna il giorno come attivo, un valore vuoto cancellerebbe la chiave. la scrittura non
+// dipende da letture e non crea conflitti tra le transazioni concorrenti dello stesso giorno
+func putDay(ctx CustomTransactionContextInterface, index string, key string, day string) error {
+	dayKey, err := ctx.GetStub().CreateCompositeKey(dayIndex(index), []string{key, day})
+	if err != nil {
+		return err
+	}
+	return ctx.GetStub().PutState(dayKey, []byte{0})
+}
+
+// giorni attivi per key nell'intervallo, in ordine
+func activeDays(ctx CustomTransactionContextInterface, index string, key string, days *dayRange) ([]string, error) {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(dayIndex(index), []string{key})
+	if err != nil {
+		return nil, err
+	}
+	defer iterator.Close()
+
+	var active []string
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(entry.Key)
+		if err != nil {
+			return nil, err
+		}
+		if len(attrs) == 2 && days.contains(attrs[1]) {
+			active = append(active, attrs[1])
+		}
+	}
+	return active, nil
+}
+
+// intervallo di giorni nel formato 2006-01-02, estremi inclusi e opzionali
+type dayRange struct {
+	From string
+	To   string
+}
+
+func parseDayRange(from string, to string) (*dayRange, error) {
+	for _, day := range []string{from, to} {
+		if day == "" {
+			continue
+		}
+		_, err := time.Parse(dayLayout, day)
+		if err != nil {
+			return nil, fmt.Errorf("invalid day %s, expected YYYY-MM-DD", day)
+		}
+	}
+	if from != "" && to != "" && from > to {
+		return nil, fmt.Errorf("empty range: %s is after %s", from, to)
+	}
+	return &dayRange{From: from, To: to}, nil
+}
+
+func (r *dayRange) contains(day string) bool {
+	return (r.From == "" || day >= r.From) && (r.To == "" || day <= r.To)
+}
+
+// legge le voci dell'indice per key nell'intervallo di giorni, con una query per ciascun giorno attivo
+func readUsage(ctx CustomTransactionContextInterface, index string, key string, days *dayRange, fn func(day string, record *UsageRecord)) error {
+	active, err := activeDays(ctx, index, key, days)
+	if err != nil {
+		return err
+	}
+	for _, day := range active {
+		err = readUsageDay(ctx, index, key, day, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readUsageDay(ctx CustomTransactionContextInterface, index string, key string, day string, fn func(day string, record *UsageRecord)) error {
+	iterator, err := ctx.GetStub().GetStateByPartialCompositeKey(index, []string{key, day})
+	if err != nil {
+		return err
+	}
+	defer iterator.Close()
+
+	for iterator.HasNext() {
+		entry, err := iterator.Next()
+		if err != nil {
+			return fmt.Errorf("error reading iterator: %s", err)
+		}
+		record := new(UsageRecord)
+		err = json.Unmarshal(entry.Value, record)
+		if err != nil {
+			return fmt.Errorf("error unmarshaling usage: %s", err)
+		}
+		fn(day, record)
+	}
+	return nil
+}
+
+type DayStats struct {
+	Day    string `json:"day"`
+	Calls  int    `json:"calls"`
+	Runs   int    `json:"runs"`
+	Earned int    `json:"earned"`
+}
+
+// statistiche di un modello nell'intervallo. Calls conta le transazioni RunModel,
+// Runs gli elementi eseguiti, Earned i token ricevuti dal creatore per esecuzioni e licenze
+type ModelStats struct {
+	Model       string     `json:"model"`
+	From        string     `json:"from,omitempty" metadata:",optional"`
+	To          string     `json:"to,omitempty" metadata:",optional"`
+	Calls       int        `json:"calls"`
+	Runs        int        `json:"runs"`
+	UniqueUsers int        `json:"unique_users"`
+	Licenses    int        `json:"licenses"`
+	Earned      int        `json:"earned"`
+	Days        []DayStats `json:"days"`
+}
+
+// il creatore può leggere le statistiche dei propri modelli, l'amministratore di tutti
+func checkStatsAccess(ctx CustomTransactionContextInterface, owner string) error {
+	userID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return err
+	}
+	if userID == owner {
+		return nil
+	}
+	return checkAdmin(ctx)
+}
+
+// statistiche giornaliere del modello tra from e to (YYYY-MM-DD, inclusi, vuoti per nessun limite)
+func (sc *SmartContract) GetModelStats(ctx CustomTransactionContextInterface, name string, from string, to string) (*ModelStats, error) {
+	model := ctx.Model()
+
+	err := checkStatsAccess(ctx, model.Creator)
+	if err != nil {
+		return nil, err
+	}
+	days, err := parseDayRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := ModelStats{Model: name, From: from, To: to, Days: []DayStats{}}
+	byDay := make(map[string]*DayStats)
+	users := make(map[string]bool)
+
+	err = readUsage(ctx, usageIndex, name, days, func(day string, record *UsageRecord) {
+		dayStats, exists := byDay[day]
+		if !exists {
+			dayStats = &DayStats{Day: day}
+			byDay[day] = dayStats
+		}
+		if record.Kind == UsageRun {
+			dayStats.Calls++
+			dayStats.Runs += record.Runs
+			users[record.User] = true
+		} else {
+			stats.Licenses++
+		}
+		dayStats.Earned += record.Earned
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dayStats := range byDay {
+		stats.Calls += dayStats.Calls
+		stats.Runs += dayStats.Runs
+		stats.Earned += dayStats.Earned
+		stats.Days = append(stats.Days, *dayStats)
+	}
+	sort.Slice(stats.Days, func(i, j int) bool { return stats.Days[i].Day < stats.Days[j].Day })
+	stats.UniqueUsers = len(users)
+	return &stats, nil
+}
+
+type CreatorEarnings struct {
+	Creator string         `json:"creator"`
+	From    string         `json:"from,omitempty" metadata:",optional"`
+	To      string         `json:"to,omitempty" metadata:",optional"`
+	Total   int            `json:"total"`
+	Models  map[string]int `json:"models"`
+	Days    []DayStats     `json:"days"`
+}
+
+// token ricevuti dal creatore per modello e per giorno. con creator vuoto restituisce
+// i guadagni del chiamante
+func (sc *SmartContract) GetCreatorEarnings(ctx CustomTransactionContextInterface, creator string, from string, to string) (*CreatorEarnings, error) {
+	if creator == "" {
+		userID, err := ctx.GetClientIdentity().GetID()
+		if err != nil {
+			return nil, err
+		}
+		creator = userID
+	}
+	err := checkStatsAccess(ctx, creator)
+	if err != nil {
+		return nil, err
+	}
+	days, err := parseDayRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	earnings := CreatorEarnings{Creator: creator, From: from, To: to, Models: make(map[string]int), Days: []DayStats{}}
+	byDay := make(map[string]*DayStats)
+
+	err = readUsage(ctx, earningsIndex, creator, days, func(day string, record *UsageRecord) {
+		dayStats, exists := byDay[day]
+		if !exists {
+			dayStats = &DayStats{Day: day}
+			byDay[day] = dayStats
+		}
+		if record.Kind == UsageRun {
+			dayStats.Calls++
+			dayStats.Runs += record.Runs
+		}
+		dayStats.Earned += record.Earned
+		earnings.Models[record.Model] += record.Earned
+		earnings.Total += record.Earned
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dayStats := range byDay {
+		earnings.Days = append(earnings.Days, *dayStats)
+	}
+	sort.Slice(earnings.Days, func(i, j int) bool { return earnings.Days[i].Day < earnings.Days[j].Day })
+	return &earnings, nil
+}
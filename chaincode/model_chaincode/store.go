@@ -0,0 +1,429 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sorgente da cui scaricare l'archivio di un modello
+type ModelStore interface {
+	Fetch(location *url.URL) (io.ReadCloser, error)
+}
+
+// configurazione dei backend, letta dall'ambiente del peer
+var (
+	ipfsStore = &IPFSStore{
+		API:     envString("IPFS_API", "ipfs_host:5001"),
+		Timeout: time.Duration(envInt("IPFS_TIMEOUT", 60)) * time.Second,
+		Retries: envInt("IPFS_RETRIES", 3),
+	}
+	localStore = &LocalStore{Root: envString("MODEL_STORE_DIR", "./store")}
+	httpStore  = &HTTPStore{Client: &http.Client{Timeout: time.Duration(envInt("HTTP_STORE_TIMEOUT", 120)) * time.Second}}
+	s3Store    = &S3Store{
+		Endpoint:  envString("S3_ENDPOINT", "http://s3_host:9000"),
+		Region:    envString("S3_REGION", "us-east-1"),
+		AccessKey: os.Getenv("S3_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_SECRET_KEY"),
+		Client:    &http.Client{Timeout: time.Duration(envInt("HTTP_STORE_TIMEOUT", 120)) * time.Second},
+	}
+)
+
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// interpreta la posizione di un modello. una stringa senza schema è un CID di ipfs.
+// il frammento sha256=<hex> indica il digest atteso dell'archivio, obbligatorio per tutti gli
+// schemi tranne ipfs: il contenuto di un file, di un URL o di un oggetto s3 può cambiare,
+// mentre il CID identifica già il contenuto
+func parseLocation(location string) (*url.URL, error) {
+	if !strings.Contains(location, "://") {
+		location = "ipfs://" + location
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid model location %s: %s", location, err)
+	}
+	if u.Scheme != "ipfs" {
+		digest := expectedDigest(u)
+		if digest == "" {
+			return nil, fmt.Errorf("%s locations need the expected digest as #sha256=<hex>", u.Scheme)
+		}
+		if _, err := hex.DecodeString(digest); err != nil || len(digest) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid sha256 digest %s", digest)
+		}
+	}
+	return u, nil
+}
+
+func storeFor(u *url.URL) (ModelStore, error) {
+	switch u.Scheme {
+	case "ipfs":
+		return ipfsStore, nil
+	case "file":
+		return localStore, nil
+	case "http", "https":
+		return httpStore, nil
+	case "s3":
+		return s3Store, nil
+	}
+	return nil, fmt.Errorf("unsupported model location scheme %s", u.Scheme)
+}
+
+func expectedDigest(u *url.URL) string {
+	if strings.HasPrefix(u.Fragment, "sha256=") {
+		return strings.ToLower(strings.TrimPrefix(u.Fragment, "sha256="))
+	}
+	return ""
+}
+
+// scarica l'archivio del modello da location, verificandone il CID per ipfs e il digest se indicato
+func fetchModel(location *url.URL) (io.ReadCloser, error) {
+	store, err := storeFor(location)
+	if err != nil {
+		return nil, err
+	}
+	r, err := store.Fetch(location)
+	if err != nil {
+		return nil, err
+	}
+	if location.Scheme == "ipfs" {
+		expected, err := ipfsCID(location)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		verifier, err := newCIDReader(r, expected)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r = verifier
+	}
+	if digest := expectedDigest(location); digest != "" {
+		return &digestReader{r: r, h: sha256.New(), expected: digest}, nil
+	}
+	return r, nil
+}
+
+// nome della directory del modello, legato al contenuto dell'archivio: il CID per ipfs,
+// altrimenti il digest atteso, così un nuovo contenuto allo stesso URL non sostituisce i file
+// dei modelli già salvati
+func modelDirName(location *url.URL) string {
+	if location.Scheme == "ipfs" {
+		return location.Host + location.Path
+	}
+	return "sha256-" + expectedDigest(location)
+}
+
+// verifica il digest dei dati letti alla fine del flusso, prima di restituire io.EOF
+type digestReader struct {
+	r        io.ReadCloser
+	h        hash.Hash
+	expected string
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if err == io.EOF {
+		if actual := hex.EncodeToString(d.h.Sum(nil)); actual != d.expected {
+			return n, fmt.Errorf("archive digest %s doesn't match expected %s", actual, d.expected)
+		}
+	}
+	return n, err
+}
+
+func (d *digestReader) Close() error {
+	return d.r.Close()
+}
+
+type IPFSStore struct {
+	API     string
+	Timeout time.Duration
+	Retries int
+}
+
+func (s *IPFSStore) Fetch(location *url.URL) (io.ReadCloser, error) {
+	cid := location.Host + location.Path
+
+	sh := s.shell()
+
+	var err error
+	for attempt := 0; attempt <= s.Retries; attempt++ {
+		var r io.ReadCloser
+		r, err = sh.Cat(cid)
+		if err == nil {
+			return r, nil
+		}
+		log.Printf("error fetching %s from ipfs, attempt %d: %s", cid, attempt+1, err)
+	}
+	return nil, err
+}
+
+// archivi in una directory locale del peer, con posizioni file://<percorso relativo>
+type LocalStore struct {
+	Root string
+}
+
+func (s *LocalStore) Fetch(location *url.URL) (io.ReadCloser, error) {
+	rel, err := entryPath(strings.TrimPrefix(location.Host+location.Path, "/"))
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(s.Root, filepath.FromSlash(rel)))
+}
+
+type HTTPStore struct {
+	Client *http.Client
+}
+
+func (s *HTTPStore) Fetch(location *url.URL) (io.ReadCloser, error) {
+	u := *location
+	u.Fragment = ""
+	response, err := s.Client.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("error fetching %s: %s", u.String(), response.Status)
+	}
+	return response.Body, nil
+}
+
+// bucket compatibile con S3, con posizioni s3://bucket/chiave e richieste firmate con SigV4
+type S3Store struct {
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Client    *http.Client
+}
+
+func (s *S3Store) Fetch(location *url.URL) (io.ReadCloser, error) {
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid S3 endpoint %s: %s", s.Endpoint, err)
+	}
+	endpoint.Path = path.Join("/", location.Host, location.Path)
+
+	request, err := http.NewRequest(http.MethodGet, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if s.AccessKey != "" {
+		s.sign(request, time.Now().UTC())
+	}
+
+	response, err := s.Client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("error fetching %s: %s", location.String(), response.Status)
+	}
+	return response.Body, nil
+}
+
+// firma AWS Signature Version 4 di una richiesta GET senza corpo
+func (s *S3Store) sign(request *http.Request, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := hex.EncodeToString(sha256Sum(nil))
+
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		"host:" + request.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(sha256Sum([]byte(canonicalRequest))),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func sha256Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// scarica ed estrae i file del modello se mancano su questo peer, ad esempio perché non ha
+// approvato SaveModel. i file vengono verificati con l'hash registrato prima di essere
+// installati, e le richieste concorrenti per lo stesso modello eseguono un solo download
+func ensureModelFiles(model *Model) error {
+	_, err := os.Stat(model.Location)
+	if err == nil {
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return fetches.do(model.Location, func() error {
+		_, err := os.Stat(model.Location)
+		if err == nil {
+			return nil
+		}
+
+		log.Printf("model %s missing on this peer, fetching from %s", model.Name, model.source())
+
+		location, err := parseLocation(model.source())
+		if err != nil {
+			return err
+		}
+		file, err := fetchModel(location)
+		if err != nil {
+			return fmt.Errorf("error fetching model %s", err)
+		}
+		defer file.Close()
+
+		tmp, err := extractTemp(file, model.Location, defaultExtractPolicy)
+		if err != nil {
+			return fmt.Errorf("error extracting file %s", err)
+		}
+
+		err = checkHashDir(model, tmp)
+		if err != nil {
+			os.RemoveAll(tmp)
+			return fmt.Errorf("fetched model %s: %s", model.Name, err)
+		}
+		return installDir(tmp, model.Location)
+	})
+}
+
+// esito della sincronizzazione di un modello, o directory rimossa perché non più usata.
+// Model è vuoto per le directory rimosse
+type SyncResult struct {
+	Model   string `json:"model"`
+	Removed string `json:"removed,omitempty" metadata:",optional"`
+	Error   string `json:"error,omitempty" metadata:",optional"`
+}
+
+// rimuove dal disco del peer le directory dei modelli che nessun modello attivo usa più,
+// come quelle dei modelli ritirati o eliminati. le directory temporanee delle estrazioni
+// in corso iniziano con un punto e vengono ignorate
+func pruneModelDirs(used map[string]bool) ([]SyncResult, error) {
+	entries, err := os.ReadDir(MODELS_FOLDER)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var results []SyncResult
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || used[entry.Name()] {
+			continue
+		}
+		dir := filepath.Join(MODELS_FOLDER, entry.Name())
+		result := SyncResult{Removed: entry.Name()}
+		err = removeModelDir(dir)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func removeModelDir(dir string) error {
+	lock, err := lockModelDir(dir, true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+	return os.RemoveAll(dir)
+}
+
+// scarica su questo peer i file di tutti i modelli attivi registrati e rimuove quelli
+// non più usati. va eseguita come query su ogni peer da sincronizzare
+func (sc *SmartContract) SyncModels(ctx CustomTransactionContextInterface) ([]SyncResult, error) {
+	err := checkAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %s", err)
+	}
+	defer resultsIterator.Close()
+
+	results := []SyncResult{}
+	used := make(map[string]bool)
+
+	for resultsIterator.HasNext() {
+		m, err := resultsIterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+
+		model, err := modelFromBytes(m.Value)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling: %s", err)
+		}
+		if !model.isActive() {
+			continue
+		}
+		used[filepath.Base(model.Location)] = true
+
+		result := SyncResult{Model: model.Name}
+		err = ensureModelFiles(model)
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	removed, err := pruneModelDirs(used)
+	if err != nil {
+		return nil, err
+	}
+	return append(results, removed...), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+// limiti sugli input accettati da RunModel
+const (
+	maxInputBytes = 64 << 20
+	maxInputRank  = 8
+)
+
+// dimensione in byte di un elemento per i tipi a dimensione fissa
+var dataTypeSizes = map[tf.DataType]int64{
+	tf.Float:      4,
+	tf.Double:     8,
+	tf.Int32:      4,
+	tf.Uint32:     4,
+	tf.Uint8:      1,
+	tf.Int16:      2,
+	tf.Int8:       1,
+	tf.Complex64:  8,
+	tf.Int64:      8,
+	tf.Uint64:     8,
+	tf.Bool:       1,
+	tf.Bfloat16:   2,
+	tf.Uint16:     2,
+	tf.Complex128: 16,
+	tf.Half:       2,
+}
+
+// verifica che un input della firma possa essere costruito da byte: tipo a dimensione fissa
+// e forma nota a parte la dimensione del batch
+func validateInputDef(input Data) error {
+	if _, exists := dataTypeSizes[input.DataType]; !exists {
+		return fmt.Errorf("input %s has unsupported datatype %s", input.Key, dataTypeName(input.DataType))
+	}
+	if len(input.Shape) > maxInputRank {
+		return fmt.Errorf("input %s has rank %d, the limit is %d", input.Key, len(input.Shape), maxInputRank)
+	}
+	for i, dim := range input.Shape {
+		if i > 0 && dim <= 0 {
+			return fmt.Errorf("input %s has unknown dimension %d in shape %v, declare the shape explicitly", input.Key, i, input.Shape)
+		}
+	}
+
+	// dimensione di un elemento, calcolata senza overflow: le forme dichiarate al salvataggio
+	// non possono superare il limite di RunModel
+	itemBytes := dataTypeSizes[input.DataType]
+	for _, dim := range input.batchShape(1) {
+		if dim < 0 {
+			return fmt.Errorf("input %s has invalid batch dimension in shape %v", input.Key, input.Shape)
+		}
+		if dim > 0 && itemBytes > maxInputBytes/dim {
+			return fmt.Errorf("input %s with shape %v exceeds the limit of %d bytes", input.Key, input.Shape, maxInputBytes)
+		}
+		itemBytes *= dim
+	}
+	return nil
+}
+
+// verifica che data contenga esattamente un tensore dell'input con batch elementi
+func validateInput(input Data, data []byte, batch int) error {
+	err := validateInputDef(input)
+	if err != nil {
+		return err
+	}
+
+	if len(input.Shape) == 0 && batch != 1 {
+		return fmt.Errorf("input %s is a scalar and can't be batched", input.Key)
+	}
+	if batch != 1 && !input.batchable() {
+		return fmt.Errorf("input %s has fixed first dimension %d and can't be batched", input.Key, input.Shape[0])
+	}
+
+	if len(data) > maxInputBytes {
+		return fmt.Errorf("input %s: received %d bytes, the limit is %d", input.Key, len(data), maxInputBytes)
+	}
+
+	// validateInputDef limita un elemento a maxInputBytes e il batch a maxBatchSize elementi,
+	// il prodotto non può superare int64
+	size := dataTypeSizes[input.DataType]
+	shape := input.batchShape(batch)
+	elements := int64(1)
+	for _, dim := range shape {
+		elements *= dim
+	}
+	expected := elements * size
+
+	if int64(len(data)) != expected {
+		return fmt.Errorf("input %s: expected %d bytes (shape %v, %s of %d bytes), received %d",
+			input.Key, expected, shape, dataTypeName(input.DataType), size, len(data))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+
+	tf "github.com/galeone/tensorflow/tensorflow/go"
+)
+
+func TestValidateInputDefSize(t *testing.T) {
+	tests := []struct {
+		name  string
+		dtype tf.DataType
+		shape []int64
+		valid bool
+	}{
+		{"image batch", tf.Float, []int64{-1, 224, 224, 3}, true},
+		{"scalar", tf.Int64, []int64{}, true},
+		{"exactly the limit", tf.Uint8, []int64{-1, maxInputBytes}, true},
+		{"one byte over the limit", tf.Uint8, []int64{1, maxInputBytes + 1}, false},
+		{"above the limit", tf.Float, []int64{-1, 4096, 4096, 4}, false},
+		// 2^62 elementi da 4 byte: senza controllo il prodotto diventerebbe 0
+		{"overflow to zero", tf.Float, []int64{-1, 1 << 31, 1 << 31}, false},
+		{"overflow to a small value", tf.Double, []int64{-1, 1 << 61, 2}, false},
+		{"invalid batch dimension", tf.Float, []int64{-2, 4}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateInputDef(Data{Key: "x", DataType: test.dtype, Shape: test.shape})
+			if test.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !test.valid && err == nil {
+				t.Fatalf("shape %v accepted", test.shape)
+			}
+		})
+	}
+}
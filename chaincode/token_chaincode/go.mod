@@ -2,4 +2,7 @@ module github.com/sapone.andrea/tesi/chaincode/user_chaincode
 
 go 1.16
 
-require github.com/hyperledger/fabric-contract-api-go v1.1.1
+require (
+	github.com/hyperledger/fabric-chaincode-go v0.0.0-20200424173110-d7076418f212
+	github.com/hyperledger/fabric-contract-api-go v1.1.1
+)
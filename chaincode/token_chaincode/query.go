@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// condizioni che identificano i documenti degli utenti tra le chiavi del world state
+var userDocument = selector{
+	"id":   map[string]interface{}{"$exists": true},
+	"role": map[string]interface{}{"$exists": true},
+}
+
+// pagina di una query con selettore. Bookmark è vuoto dopo l'ultima pagina
+type UserQueryPage struct {
+	Users    []*User `json:"users"`
+	Bookmark string  `json:"bookmark"`
+	Fetched  int     `json:"fetched"`
+}
+
+// ricerca degli utenti con un selettore Mango di CouchDB, ad esempio {"role": "dev", "authorized": true}.
+// su LevelDB sono supportati solo gli operatori elencati in selector.go
+// riservata all'organizzazione che autorizza gli utenti, va eseguita come query
+func (sc *SmartContract) QueryUsers(ctx contractapi.TransactionContextInterface, query string, pageSize int, bookmark string) (*UserQueryPage, error) {
+	mspid, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return nil, err
+	}
+	if mspid != "Org2MSP" {
+		return nil, fmt.Errorf("not allowed to query users. msp: %s", mspid)
+	}
+
+	s, err := parseSelector(query)
+	if err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 {
+		pageSize = defaultPageSize
+	}
+	if pageSize > maxPageSize {
+		return nil, fmt.Errorf("page size %d exceeds the limit of %d", pageSize, maxPageSize)
+	}
+
+	page, err := querySelector(ctx.GetStub(), s, userDocument, int32(pageSize), bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	result := UserQueryPage{Users: []*User{}, Bookmark: page.Bookmark, Fetched: len(page.Keys)}
+	for _, value := range page.Values {
+		user := new(User)
+		err = json.Unmarshal(value, user)
+		if err != nil {
+			return nil, fmt.Errorf("error unmarshaling user: %v", err)
+		}
+		result.Users = append(result.Users, user)
+	}
+	return &result, nil
+}
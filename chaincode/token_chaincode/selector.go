@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+)
+
+// valutazione dei selettori Mango di CouchDB sui documenti degli utenti, usata al posto delle
+// rich query quando il peer usa LevelDB. i documenti degli utenti non hanno campi annidati né
+// array, quindi sono supportati solo l'uguaglianza implicita, $eq, $ne, $gt, $gte, $lt, $lte,
+// $in, $nin, $exists, $and e $or. con CouchDB il selettore è passato così com'è
+type selector map[string]interface{}
+
+func parseSelector(query string) (selector, error) {
+	var s selector
+	err := json.Unmarshal([]byte(query), &s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing selector: %s", err)
+	}
+	if s == nil {
+		return nil, errors.New("empty selector")
+	}
+	// accetta anche una query completa nella forma {"selector": {...}}
+	if inner, exists := s["selector"].(map[string]interface{}); exists && len(s) == 1 {
+		s = inner
+	}
+	return s, nil
+}
+
+// query CouchDB con il selettore richiesto e le condizioni che identificano il tipo di documento
+func (s selector) query(kind selector) (string, error) {
+	queryBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"$and": []interface{}{map[string]interface{}(s), map[string]interface{}(kind)}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(queryBytes), nil
+}
+
+func (s selector) match(doc map[string]interface{}) (bool, error) {
+	for field, condition := range s {
+		var ok bool
+		var err error
+		switch field {
+		case "$and", "$or":
+			ok, err = matchCombination(field, condition, doc)
+		default:
+			if strings.HasPrefix(field, "$") {
+				return false, fmt.Errorf("unsupported operator %s", field)
+			}
+			value, exists := doc[field]
+			ok, err = matchCondition(condition, value, exists)
+		}
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchCombination(op string, condition interface{}, doc map[string]interface{}) (bool, error) {
+	subs, isArray := condition.([]interface{})
+	if !isArray {
+		return false, fmt.Errorf("%s needs an array of selectors", op)
+	}
+	matched := 0
+	for _, sub := range subs {
+		subSelector, isMap := sub.(map[string]interface{})
+		if !isMap {
+			return false, fmt.Errorf("%s needs an array of selectors", op)
+		}
+		ok, err := selector(subSelector).match(doc)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			matched++
+		}
+	}
+	if op == "$and" {
+		return matched == len(subs), nil
+	}
+	return matched > 0, nil
+}
+
+// una condizione è un valore da confrontare per uguaglianza o un oggetto di operatori
+func matchCondition(condition interface{}, value interface{}, exists bool) (bool, error) {
+	operators, isMap := condition.(map[string]interface{})
+	if !isMap {
+		return exists && equalValues(condition, value), nil
+	}
+
+	for op, arg := range operators {
+		ok, err := matchOperator(op, arg, value, exists)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchOperator(op string, arg interface{}, value interface{}, exists bool) (bool, error) {
+	switch op {
+	case "$exists":
+		want, isBool := arg.(bool)
+		if !isBool {
+			return false, errors.New("$exists needs a boolean")
+		}
+		return exists == want, nil
+	case "$ne":
+		return !exists || !equalValues(arg, value), nil
+	case "$eq":
+		return exists && equalValues(arg, value), nil
+	case "$in", "$nin":
+		values, isArray := arg.([]interface{})
+		if !isArray {
+			return false, fmt.Errorf("%s needs an array", op)
+		}
+		found := false
+		for _, v := range values {
+			if exists && equalValues(v, value) {
+				found = true
+				break
+			}
+		}
+		return found == (op == "$in"), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		if !exists {
+			return false, nil
+		}
+		cmp, comparable := compareValues(value, arg)
+		if !comparable {
+			return false, nil
+		}
+		switch op {
+		case "$gt":
+			return cmp > 0, nil
+		case "$gte":
+			return cmp >= 0, nil
+		case "$lt":
+			return cmp < 0, nil
+		}
+		return cmp <= 0, nil
+	}
+	return false, fmt.Errorf("unsupported operator %s", op)
+}
+
+func equalValues(a interface{}, b interface{}) bool {
+	aBytes, errA := json.Marshal(a)
+	bBytes, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(aBytes) == string(bBytes)
+}
+
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	}
+	return 0, false
+}
+
+// risultato di una query con selettore: i documenti corrispondenti e il bookmark della pagina successiva
+type selectorPage struct {
+	Keys     []string
+	Values   [][]byte
+	Bookmark string
+}
+
+// rich query di CouchDB con paginazione. se il peer usa LevelDB i documenti delle chiavi semplici
+// vengono letti in ordine di chiave e filtrati con il selettore, e il bookmark è l'ultima chiave restituita
+func querySelector(stub shim.ChaincodeStubInterface, s selector, kind selector, pageSize int32, bookmark string) (*selectorPage, error) {
+	query, err := s.query(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	iterator, metadata, err := stub.GetQueryResultWithPagination(query, pageSize, bookmark)
+	if err == nil {
+		defer iterator.Close()
+		page := &selectorPage{Bookmark: metadata.GetBookmark()}
+		for iterator.HasNext() {
+			entry, err := iterator.Next()
+			if err != nil {
+				return nil, fmt.Errorf("error reading iterator: %s", err)
+			}
+			page.Keys = append(page.Keys, entry.Key)
+			page.Values = append(page.Values, entry.Value)
+		}
+		if metadata.GetFetchedRecordsCount() < pageSize {
+			page.Bookmark = ""
+		}
+		return page, nil
+	}
+	if !strings.Contains(err.Error(), "not supported for leveldb") {
+		return nil, fmt.Errorf("error running query: %s", err)
+	}
+
+	return scanSelector(stub, selector{"$and": []interface{}{map[string]interface{}(s), map[string]interface{}(kind)}}, pageSize, bookmark)
+}
+
+func scanSelector(stub shim.ChaincodeStubInterface, s selector, pageSize int32, bookmark string) (*selectorPage, error) {
+	start := ""
+	if bookmark != "" {
+		start = bookmark + "\x00"
+	}
+	iterator, err := stub.GetStateByRange(start, "")
+	if err != nil {
+		return nil, fmt.Errorf("error reading state: %s", err)
+	}
+	defer iterator.Close()
+
+	page := new(selectorPage)
+	for iterator.HasNext() {
+		if len(page.Keys) == int(pageSize) {
+			page.Bookmark = page.Keys[len(page.Keys)-1]
+			break
+		}
+		entry, err := iterator.Next()
+		if err != nil {
+			return nil, fmt.Errorf("error reading iterator: %s", err)
+		}
+
+		var doc map[string]interface{}
+		if json.Unmarshal(entry.Value, &doc) != nil {
+			continue
+		}
+		ok, err := s.match(doc)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			page.Keys = append(page.Keys, entry.Key)
+			page.Values = append(page.Values, entry.Value)
+		}
+	}
+	return page, nil
+}
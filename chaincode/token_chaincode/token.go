@@ -24,6 +24,8 @@ type event struct {
 type Prices struct {
 	Upload int `json:"upload"`
 	Use    int `json:"use"`
+	// prezzo fisso di un'esecuzione in batch, se 0 si paga Use per ogni elemento
+	Batch int `json:"batch"`
 }
 
 func (sc *SmartContract) SetPrices(ctx contractapi.TransactionContextInterface, upload int, use int) error {
@@ -37,7 +39,41 @@ func (sc *SmartContract) SetPrices(ctx contractapi.TransactionContextInterface,
 		return fmt.Errorf("client is not authorized to set prices")
 	}
 
-	prices := Prices{Upload: upload, Use: use}
+	prices, err := getPrices(ctx)
+	if err != nil {
+		prices = new(Prices)
+	}
+	prices.Upload = upload
+	prices.Use = use
+
+	pricesBytes, err := json.Marshal(prices)
+	if err != nil {
+		return err
+	}
+
+	return ctx.GetStub().PutState(pricesKey, pricesBytes)
+}
+
+func (sc *SmartContract) SetBatchPrice(ctx contractapi.TransactionContextInterface, batch int) error {
+	MSPID, err := ctx.GetClientIdentity().GetMSPID()
+
+	if err != nil {
+		return err
+	}
+
+	if MSPID != msp {
+		return fmt.Errorf("client is not authorized to set prices")
+	}
+
+	if batch < 0 {
+		return errors.New("batch price can't be negative")
+	}
+
+	prices, err := getPrices(ctx)
+	if err != nil {
+		return err
+	}
+	prices.Batch = batch
 
 	pricesBytes, err := json.Marshal(prices)
 	if err != nil {
@@ -227,6 +263,37 @@ func (sc *SmartContract) PayForModel(ctx contractapi.TransactionContextInterface
 		return err
 	}
 
+	return payForModel(ctx, to, model, prices.Use)
+}
+
+// pagamento di un'esecuzione in batch di count elementi
+func (sc *SmartContract) PayForBatch(ctx contractapi.TransactionContextInterface, to string, model string, count int) error {
+	prices, err := getPrices(ctx)
+	if err != nil {
+		return err
+	}
+
+	if count <= 0 {
+		return errors.New("batch size must be a positive integer")
+	}
+
+	return payForModel(ctx, to, model, prices.batchPrice(count))
+}
+
+// prezzo di un'esecuzione di count elementi: Use per un solo elemento, il prezzo fisso del batch
+// se impostato, altrimenti Use per ogni elemento. la stessa regola è usata dal chaincode dei modelli
+func (p *Prices) batchPrice(count int) int {
+	if count == 1 {
+		return p.Use
+	}
+	if p.Batch > 0 {
+		return p.Batch
+	}
+	return p.Use * count
+}
+
+// il chiamante paga price all'admin e, se diverso dal creatore del modello, price al creatore
+func payForModel(ctx contractapi.TransactionContextInterface, to string, model string, price int) error {
 	from, err := ctx.GetClientIdentity().GetID()
 	if err != nil {
 		return err
@@ -257,7 +324,7 @@ func (sc *SmartContract) PayForModel(ctx contractapi.TransactionContextInterface
 	}
 
 	if from != to {
-		if fromUser.Balance < prices.Use*2 {
+		if fromUser.Balance < price*2 {
 			return fmt.Errorf("client account %s has insufficient funds", from)
 		}
 
@@ -270,25 +337,25 @@ func (sc *SmartContract) PayForModel(ctx contractapi.TransactionContextInterface
 		if err != nil {
 			return err
 		}
-		toUser.Balance += prices.Use
-		fromUser.Balance -= prices.Use
+		toUser.Balance += price
+		fromUser.Balance -= price
 		updatedToUserBytes, _ := json.Marshal(toUser)
 
 		ctx.GetStub().PutState(to, updatedToUserBytes)
 	} else {
-		if fromUser.Balance < prices.Use {
+		if fromUser.Balance < price {
 			return fmt.Errorf("client account %s has insufficient funds", from)
 		}
 
 	}
-	fromUser.Balance -= prices.Use
-	admin.Balance += prices.Use
+	fromUser.Balance -= price
+	admin.Balance += price
 	updatedFromUserBytes, _ := json.Marshal(fromUser)
 	updatedAdmin, _ := json.Marshal(admin)
 	ctx.GetStub().PutState(from, updatedFromUserBytes)
 	ctx.GetStub().PutState(adminID, updatedAdmin)
 
-	log.Printf("client %s paid %d to admin and %s to use model %s", from, prices.Use, to, model)
+	log.Printf("client %s paid %d to admin and %s to use model %s", from, price, to, model)
 	return nil
 }
 